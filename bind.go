@@ -0,0 +1,119 @@
+package sharding
+
+import (
+	"fmt"
+)
+
+// binding strategy, a child model follows the routing of its parent model so
+// both live on the same alias and table suffix and a transaction touching
+// both stays on one shard. lookup maps the shard key value of child to the
+// shard key value of parent, nil lookup means they are the same value:
+//   RegisterModel(&OrderItem{}, NewBind(&Order{}, func(orderId interface{}) (interface{}, error) {
+//       return userIdOfOrder(orderId)
+//   }))
+// the parent strategy is resolved on use, so parent can be registered later
+type BindStrategy struct {
+	parent string
+	lookup func(value interface{}) (interface{}, error)
+	reg    *Registry
+}
+
+func NewBind(parent interface{}, lookup func(value interface{}) (interface{}, error)) *BindStrategy {
+	return &BindStrategy{parent: getFullName(parent), lookup: lookup}
+}
+
+func (s *BindStrategy) Shard(table string, value interface{}) (string, string, error) {
+	ps, err := s.strategy()
+	if err != nil {
+		return "", "", err
+	}
+	if s.lookup != nil {
+		if value, err = s.lookup(value); err != nil {
+			return "", "", err
+		}
+	}
+	return ps.Shard(table, value)
+}
+
+func (s *BindStrategy) Shards(table string) ([]Target, error) {
+	ps, err := s.strategy()
+	if err != nil {
+		return nil, err
+	}
+	return ps.Shards(table)
+}
+
+func (s *BindStrategy) bindRegistry(r *Registry) {
+	s.reg = r
+}
+
+// strategy of parent model
+func (s *BindStrategy) strategy() (ShardStrategy, error) {
+	t := registryOf(s.reg).load()
+	m, ok := t.models[s.parent]
+	if !ok {
+		return nil, fmt.Errorf("<BindStrategy> unknown parent model name `%s`", s.parent)
+	}
+	ps := t.strategy(m)
+	if ps == nil {
+		return nil, fmt.Errorf("<BindStrategy> parent model `%s` is not sharded", s.parent)
+	}
+	return ps, nil
+}
+
+// dual write target of parent during its migration, see shadowStrategy
+func (s *BindStrategy) shadow(table string, value interface{}) (Target, bool) {
+	ps, value, ok := s.shadowParent(value)
+	if !ok {
+		return Target{}, false
+	}
+	return ps.shadow(table, value)
+}
+
+func (s *BindStrategy) shadowFailed(table string, value interface{}, err error) {
+	if ps, value, ok := s.shadowParent(value); ok {
+		ps.shadowFailed(table, value, err)
+	}
+}
+
+// a value failed to map is taken as migrating
+func (s *BindStrategy) isMigrating(values []interface{}) bool {
+	ps, err := s.strategy()
+	if err != nil {
+		return false
+	}
+	p, ok := ps.(shadowStrategy)
+	if !ok {
+		return false
+	}
+	if values == nil || s.lookup == nil {
+		return p.isMigrating(values)
+	}
+	mapped := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		pv, err := s.lookup(v)
+		if err != nil {
+			return p.isMigrating(nil)
+		}
+		mapped = append(mapped, pv)
+	}
+	return p.isMigrating(mapped)
+}
+
+// parent strategy with dual write and the parent shard key value of value
+func (s *BindStrategy) shadowParent(value interface{}) (shadowStrategy, interface{}, bool) {
+	ps, err := s.strategy()
+	if err != nil {
+		return nil, nil, false
+	}
+	p, ok := ps.(shadowStrategy)
+	if !ok {
+		return nil, nil, false
+	}
+	if s.lookup != nil {
+		if value, err = s.lookup(value); err != nil {
+			return nil, nil, false
+		}
+	}
+	return p, value, true
+}
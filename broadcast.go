@@ -0,0 +1,173 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// interval between health checks of an alias read by broadcast models
+var HealthCheckInterval = time.Second
+
+// broadcast (reference) table replicated to every alias, register the model
+// with it instead of a shard strategy:
+//   RegisterModel(&Country{}, NewBroadcast())
+// writes go to every alias in a distributed transaction which needs
+// RegisterXALog, reads go to a single healthy alias. the table keeps its
+// logical name on every alias. without aliases all registered aliases are
+// used. the model needs an `auto` primary key or a unique key so a row has
+// the same key on every alias
+type BroadcastStrategy struct {
+	mu      sync.Mutex
+	Aliases []string
+	next    int
+	checked map[string]time.Time
+	healthy map[string]bool
+	reg     *Registry
+}
+
+func NewBroadcast(aliases ...string) *BroadcastStrategy {
+	return &BroadcastStrategy{
+		Aliases: aliases,
+		checked: make(map[string]time.Time),
+		healthy: make(map[string]bool),
+	}
+}
+
+// a healthy alias in round robin, value is ignored
+func (s *BroadcastStrategy) Shard(table string, value interface{}) (string, string, error) {
+	aliases := s.aliases()
+	if len(aliases) == 0 {
+		return "", "", fmt.Errorf("<BroadcastStrategy> no db alias registered")
+	}
+	s.mu.Lock()
+	start := s.next
+	s.next++
+	s.mu.Unlock()
+	for i := range aliases {
+		alias := aliases[(start+i)%len(aliases)]
+		if s.isHealthy(alias) {
+			return alias, table, nil
+		}
+	}
+	return "", "", fmt.Errorf("<BroadcastStrategy> no healthy alias for `%s`", table)
+}
+
+// a single healthy shard, every alias holds the same rows
+func (s *BroadcastStrategy) Shards(table string) ([]Target, error) {
+	alias, table, err := s.Shard(table, nil)
+	if err != nil {
+		return nil, err
+	}
+	return []Target{{Alias: alias, Table: table}}, nil
+}
+
+func (s *BroadcastStrategy) bindRegistry(r *Registry) {
+	s.mu.Lock()
+	s.reg = r
+	s.mu.Unlock()
+}
+
+func (s *BroadcastStrategy) aliases() []string {
+	if len(s.Aliases) > 0 {
+		return s.Aliases
+	}
+	s.mu.Lock()
+	reg := s.reg
+	s.mu.Unlock()
+	dbs := registryOf(reg).load().dbs
+	aliases := make([]string, 0, len(dbs))
+	for alias := range dbs {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// ping alias at most once per HealthCheckInterval, a ping taking longer
+// than the interval fails
+func (s *BroadcastStrategy) isHealthy(alias string) bool {
+	s.mu.Lock()
+	if t, ok := s.checked[alias]; ok && time.Since(t) < HealthCheckInterval {
+		healthy := s.healthy[alias]
+		s.mu.Unlock()
+		return healthy
+	}
+	reg := s.reg
+	s.mu.Unlock()
+
+	db, ok := registryOf(reg).load().dbs[alias]
+	if ok {
+		ctx, cancel := context.WithTimeout(context.Background(), HealthCheckInterval)
+		ok = db.PingContext(ctx) == nil
+		cancel()
+	}
+
+	s.mu.Lock()
+	s.healthy[alias] = ok
+	s.checked[alias] = time.Now()
+	s.mu.Unlock()
+	return ok
+}
+
+// alias a broadcast table is read from, the copy on the alias of orm when
+// it has one, otherwise a healthy alias. a transaction reads its own alias
+func (o *orm) broadcastAlias(b *BroadcastStrategy, table string) (string, error) {
+	if len(o.aliasName) > 0 {
+		for _, alias := range b.aliases() {
+			if alias == o.aliasName {
+				return alias, nil
+			}
+		}
+		if o.isTx {
+			return "", fmt.Errorf("<orm> broadcast table `%s` has no copy on `%s` of transaction", table, o.aliasName)
+		}
+	}
+	alias, _, err := b.Shard(table, nil)
+	return alias, err
+}
+
+// exec a write on the routed shard, writes of broadcast model go to every
+// alias in the distributed transaction of orm, or in a new one
+func (o *orm) execWrite(ctx context.Context, model *modelInfo, q sqlQuerier, query string, args ...interface{}) (sql.Result, error) {
+	b, ok := o.topo.strategy(model).(*BroadcastStrategy)
+	if !ok {
+		return q.ExecContext(ctx, query, args...)
+	}
+	if o.isTx {
+		return nil, fmt.Errorf("<orm> broadcast model `%s` can't write in transaction of `%s`, use BeginXA", model.fullName, o.aliasName)
+	}
+
+	own := o.xa == nil
+	if own {
+		if err := o.BeginXA(); err != nil {
+			return nil, err
+		}
+	}
+	var res sql.Result
+	for _, alias := range b.aliases() {
+		bq, err := o.querier(ctx, alias)
+		if err == nil {
+			o.wrote(alias)
+			var r sql.Result
+			if r, err = bq.ExecContext(ctx, query, args...); res == nil {
+				res = r
+			}
+		}
+		if err != nil {
+			if own {
+				o.Rollback()
+			}
+			return nil, err
+		}
+	}
+	if own {
+		if err := o.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,317 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// logical bucket (virtual shard) strategy, shard key values are hashed into
+// a fixed number of buckets and every bucket is assigned to a db alias and
+// table suffix by a config table on the metadata alias:
+//   CREATE TABLE `table` (`bucket` INT PRIMARY KEY, `alias` VARCHAR(64) NOT NULL, `suffix` VARCHAR(64) NOT NULL,
+//     `migrate_alias` VARCHAR(64) NOT NULL DEFAULT '', `migrate_suffix` VARCHAR(64) NOT NULL DEFAULT '',
+//     `migrate_err` VARCHAR(255) NOT NULL DEFAULT '')
+// an empty suffix means the logical table, a non-empty migrate_alias is the
+// target of a migrating bucket. the map is loaded when the strategy is
+// registered and reloaded by Load, so every instance sharing the table dual writes and flips together
+type BucketStrategy struct {
+	mu        sync.RWMutex
+	buckets   int
+	alias     string
+	table     string
+	assigns   []bucketAssign
+	migrating map[int]*bucketMigrate
+	reg       *Registry
+}
+
+// assignment of a bucket
+type bucketAssign struct {
+	alias  string
+	suffix string
+}
+
+// target of a migrating bucket, writes are dual written to it
+type bucketMigrate struct {
+	to  bucketAssign
+	err error
+}
+
+func NewBucketStrategy(buckets int, alias, table string) *BucketStrategy {
+	if buckets <= 0 {
+		panic(fmt.Errorf("<sharding.NewBucketStrategy> buckets must be positive"))
+	}
+	return &BucketStrategy{buckets: buckets, alias: alias, table: table}
+}
+
+// bucket of shard key value
+func (s *BucketStrategy) Bucket(value interface{}) int {
+	return int(murmur3([]byte(ToStr(value)), 0) % uint32(s.buckets))
+}
+
+func (s *BucketStrategy) Shard(table string, value interface{}) (string, string, error) {
+	a, err := s.assign(s.Bucket(value))
+	if err != nil {
+		return "", "", err
+	}
+	return a.alias, a.table(table), nil
+}
+
+func (s *BucketStrategy) Shards(table string) ([]Target, error) {
+	if err := s.loaded(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var targets []Target
+	for _, a := range s.assigns {
+		target := Target{Alias: a.alias, Table: a.table(table)}
+		if !hasTarget(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Alias != targets[j].Alias {
+			return targets[i].Alias < targets[j].Alias
+		}
+		return targets[i].Table < targets[j].Table
+	})
+	return targets, nil
+}
+
+func (s *BucketStrategy) bindRegistry(r *Registry) {
+	s.mu.Lock()
+	s.reg = r
+	s.mu.Unlock()
+}
+
+// registry holding the config alias
+func (s *BucketStrategy) registry() *Registry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return registryOf(s.reg)
+}
+
+// load or reload the bucket map, every bucket must be assigned
+func (s *BucketStrategy) Load() error {
+	return s.load(s.registry().load())
+}
+
+// load the bucket map from the config alias of t
+func (s *BucketStrategy) load(t *topology) error {
+	db, ok := t.dbs[s.alias]
+	if !ok {
+		return fmt.Errorf("<BucketStrategy> unknown db alias name `%s`", s.alias)
+	}
+	query := fmt.Sprintf("SELECT `bucket`, `alias`, `suffix`, `migrate_alias`, `migrate_suffix`, `migrate_err` FROM %s%s%s", TableQuote, s.table, TableQuote)
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	assigns := make([]bucketAssign, s.buckets)
+	found := make([]bool, s.buckets)
+	migrating := make(map[int]*bucketMigrate)
+	for rows.Next() {
+		var (
+			bucket int
+			a, to  bucketAssign
+			merr   string
+		)
+		if err = rows.Scan(&bucket, &a.alias, &a.suffix, &to.alias, &to.suffix, &merr); err != nil {
+			return err
+		}
+		if bucket < 0 || bucket >= s.buckets {
+			return fmt.Errorf("<BucketStrategy> bucket `%d` out of range [0, %d)", bucket, s.buckets)
+		}
+		assigns[bucket], found[bucket] = a, true
+		if len(to.alias) > 0 {
+			m := &bucketMigrate{to: to}
+			if len(merr) > 0 {
+				m.err = errors.New(merr)
+			}
+			migrating[bucket] = m
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for bucket, ok := range found {
+		if !ok {
+			return fmt.Errorf("<BucketStrategy> bucket `%d` is not assigned in `%s`", bucket, s.table)
+		}
+	}
+
+	s.mu.Lock()
+	for bucket, m := range migrating {
+		// a failure recorded here but not persisted is kept
+		if old, ok := s.migrating[bucket]; ok && old.to == m.to && m.err == nil {
+			m.err = old.err
+		}
+	}
+	s.assigns, s.migrating = assigns, migrating
+	s.mu.Unlock()
+	return nil
+}
+
+// reload the bucket map every interval until stop is called,
+// errors keep the current map and are passed to onError if not nil
+func (s *BucketStrategy) AutoReload(interval time.Duration, onError func(error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.Load(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// persist a new assignment of bucket and apply it, a migration of the
+// bucket ends
+func (s *BucketStrategy) Assign(bucket int, alias, suffix string) error {
+	if bucket < 0 || bucket >= s.buckets {
+		return fmt.Errorf("<BucketStrategy> bucket `%d` out of range [0, %d)", bucket, s.buckets)
+	}
+	if err := s.loaded(); err != nil {
+		return err
+	}
+	err := s.update(bucket, "`alias` = ?, `suffix` = ?, `migrate_alias` = '', `migrate_suffix` = '', `migrate_err` = ''", alias, suffix)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	assigns := make([]bucketAssign, len(s.assigns))
+	copy(assigns, s.assigns)
+	assigns[bucket] = bucketAssign{alias: alias, suffix: suffix}
+	s.assigns = assigns
+	delete(s.migrating, bucket)
+	s.mu.Unlock()
+	return nil
+}
+
+// dual write target of the shard key value while its bucket is migrating
+func (s *BucketStrategy) shadow(table string, value interface{}) (Target, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.migrating[s.Bucket(value)]
+	if !ok {
+		return Target{}, false
+	}
+	return Target{Alias: m.to.alias, Table: m.to.table(table)}, true
+}
+
+// record a failed dual write, the migration of bucket can't be verified.
+// it is persisted so Verify on any instance sees it
+func (s *BucketStrategy) shadowFailed(table string, value interface{}, err error) {
+	bucket := s.Bucket(value)
+	s.mu.Lock()
+	m, ok := s.migrating[bucket]
+	if ok {
+		m.err = err
+	}
+	s.mu.Unlock()
+	if ok {
+		s.update(bucket, "`migrate_err` = LEFT(?, 255)", err.Error())
+	}
+}
+
+// whether a bucket of values is migrating, nil values mean any bucket
+func (s *BucketStrategy) isMigrating(values []interface{}) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if values == nil {
+		return len(s.migrating) > 0
+	}
+	for _, v := range values {
+		if _, ok := s.migrating[s.Bucket(v)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *BucketStrategy) startMigrate(bucket int, to bucketAssign) error {
+	if err := s.update(bucket, "`migrate_alias` = ?, `migrate_suffix` = ?, `migrate_err` = ''", to.alias, to.suffix); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.migrating == nil {
+		s.migrating = make(map[int]*bucketMigrate)
+	}
+	s.migrating[bucket] = &bucketMigrate{to: to}
+	return nil
+}
+
+func (s *BucketStrategy) stopMigrate(bucket int) error {
+	if err := s.update(bucket, "`migrate_alias` = '', `migrate_suffix` = '', `migrate_err` = ''"); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.migrating, bucket)
+	return nil
+}
+
+// update the row of bucket in the config table
+func (s *BucketStrategy) update(bucket int, sets string, args ...interface{}) error {
+	db, ok := s.registry().load().dbs[s.alias]
+	if !ok {
+		return fmt.Errorf("<BucketStrategy> unknown db alias name `%s`", s.alias)
+	}
+	query := fmt.Sprintf("UPDATE %s%s%s SET %s WHERE `bucket` = ?", TableQuote, s.table, TableQuote, sets)
+	_, err := db.Exec(query, append(args, bucket)...)
+	return err
+}
+
+// error of dual write during the migration of bucket
+func (s *BucketStrategy) migrateErr(bucket int) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if m, ok := s.migrating[bucket]; ok {
+		return m.err
+	}
+	return nil
+}
+
+func (s *BucketStrategy) assign(bucket int) (bucketAssign, error) {
+	if err := s.loaded(); err != nil {
+		return bucketAssign{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.assigns[bucket], nil
+}
+
+// load the map on first use
+func (s *BucketStrategy) loaded() error {
+	s.mu.RLock()
+	ok := s.assigns != nil
+	s.mu.RUnlock()
+	if ok {
+		return nil
+	}
+	return s.Load()
+}
+
+// physical table of the assignment
+func (a bucketAssign) table(table string) string {
+	if len(a.suffix) == 0 {
+		return table
+	}
+	return table + TableSuffixDelim + a.suffix
+}
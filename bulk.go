@@ -0,0 +1,322 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// max bytes of a multi-row INSERT, keep it under max_allowed_packet of server
+var InsertMultiMaxBytes = 4 << 20
+
+// ON DUPLICATE KEY UPDATE of an upsert, conflict are the columns of the
+// unique key rows conflict on
+type upsert struct {
+	conflict []string
+}
+
+// rows of a multi-row INSERT going to the same physical shard
+type insertBatch struct {
+	q     sqlQuerier
+	table string
+	rows  []int
+}
+
+// insert the models in slice with multi-row INSERT of at most batchSize rows,
+// rows are grouped by shard. it returns the total affected rows and the id of
+// every row in the order of slice, ids of db auto increment are counted from
+// the LastInsertId of the statement which needs consecutive auto increment
+// (innodb_autoinc_lock_mode 0 or 1). outside transaction statements already
+// run are kept when a later one fails
+func (o *orm) InsertMulti(batchSize int, slice interface{}) (int64, []int64, error) {
+	return o.InsertMultiContext(context.Background(), batchSize, slice)
+}
+
+func (o *orm) InsertMultiContext(ctx context.Context, batchSize int, slice interface{}) (int64, []int64, error) {
+	o.reload()
+	mds, model, err := o.sliceModels(slice)
+	if err != nil || len(mds) == 0 {
+		return 0, nil, err
+	}
+	return o.insertRows(ctx, batchSize, mds, model, nil)
+}
+
+// insert md, or update the row it conflicts with on conflictCols which
+// default to the unique and primary key. columns other than the conflict
+// columns, the primary key and the shard column are updated. it returns the
+// id of the row inserted or updated
+func (o *orm) InsertOrUpdate(md interface{}, conflictCols ...string) (int64, error) {
+	return o.InsertOrUpdateContext(context.Background(), md, conflictCols...)
+}
+
+func (o *orm) InsertOrUpdateContext(ctx context.Context, md interface{}, conflictCols ...string) (int64, error) {
+	o.reload()
+	fullName := getFullName(md)
+	model, ok := o.topo.models[fullName]
+	if !ok {
+		return 0, fmt.Errorf("<orm.InsertOrUpdate> unknown model name `%s`", fullName)
+	}
+	u, err := newUpsert(model, conflictCols)
+	if err != nil {
+		return 0, err
+	}
+	_, ids, err := o.insertRows(ctx, 1, []interface{}{md}, model, u)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// batch form of InsertOrUpdate like InsertMulti, it returns the total
+// affected rows which count 1 for an inserted row and 2 for an updated one.
+// the `auto` pk of an updated row is set to its id only with batchSize 1,
+// in a multi-row statement it keeps the unused generated id
+func (o *orm) InsertOrUpdateMulti(batchSize int, slice interface{}, conflictCols ...string) (int64, error) {
+	return o.InsertOrUpdateMultiContext(context.Background(), batchSize, slice, conflictCols...)
+}
+
+func (o *orm) InsertOrUpdateMultiContext(ctx context.Context, batchSize int, slice interface{}, conflictCols ...string) (int64, error) {
+	o.reload()
+	mds, model, err := o.sliceModels(slice)
+	if err != nil || len(mds) == 0 {
+		return 0, err
+	}
+	u, err := newUpsert(model, conflictCols)
+	if err != nil {
+		return 0, err
+	}
+	n, _, err := o.insertRows(ctx, batchSize, mds, model, u)
+	return n, err
+}
+
+func newUpsert(model *modelInfo, conflictCols []string) (*upsert, error) {
+	u := &upsert{}
+	for _, name := range conflictCols {
+		column, ok := model.column(name)
+		if !ok {
+			return nil, fmt.Errorf("<orm.InsertOrUpdate> unknown column name `%s`", name)
+		}
+		u.conflict = append(u.conflict, column)
+	}
+	if len(u.conflict) == 0 {
+		for _, column := range []string{model.uk, model.pk} {
+			if len(column) > 0 {
+				u.conflict = append(u.conflict, column)
+			}
+		}
+	}
+	if len(u.conflict) == 0 {
+		return nil, fmt.Errorf("<orm.InsertOrUpdate> model `%s` have no unique or primary key", model.fullName)
+	}
+	return u, nil
+}
+
+// ON DUPLICATE KEY UPDATE of the columns not in conflict, the primary key
+// is passed to LAST_INSERT_ID so an updated row reports its id
+func (u *upsert) clause(model *modelInfo, cols []string, sharded bool) string {
+	var sets []string
+	for _, column := range cols {
+		if column == model.pk || (sharded && column == model.shard) || hasString(u.conflict, column) {
+			continue
+		}
+		quoted := TableQuote + column + TableQuote
+		sets = append(sets, fmt.Sprintf("%s = VALUES(%s)", quoted, quoted))
+	}
+	if len(model.pk) > 0 {
+		quoted := TableQuote + model.pk + TableQuote
+		sets = append(sets, fmt.Sprintf("%s = LAST_INSERT_ID(%s)", quoted, quoted))
+	} else if len(sets) == 0 {
+		quoted := TableQuote + u.conflict[0] + TableQuote
+		sets = append(sets, fmt.Sprintf("%s = %s", quoted, quoted))
+	}
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+}
+
+// multi-row INSERT of mds, an upsert also writes the primary key so rows
+// can conflict on it, a zero value is generated by auto increment
+func (o *orm) insertRows(ctx context.Context, batchSize int, mds []interface{}, model *modelInfo, u *upsert) (int64, []int64, error) {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	cols := make([]string, 0, len(model.c2n))
+	for column := range model.c2n {
+		if column == model.pk && len(model.auto) == 0 && u == nil {
+			continue
+		}
+		cols = append(cols, column)
+	}
+	sort.Strings(cols)
+
+	var err error
+	ids := make([]int64, len(mds))
+	rows := make([][]interface{}, len(mds))
+	olds := make([]map[string]string, len(mds))
+	var batches []*insertBatch
+	for i, md := range mds {
+		if ids[i], err = o.generateId(md, model); err != nil {
+			return 0, nil, err
+		}
+		ind := reflect.Indirect(reflect.ValueOf(md))
+		rows[i] = make([]interface{}, len(cols))
+		for k, column := range cols {
+			rows[i][k] = reflect.Indirect(ind.FieldByName(model.c2n[column])).Interface()
+		}
+
+		q, table, err := o.route(ctx, md, model, false)
+		if err != nil {
+			return 0, nil, err
+		}
+		var b *insertBatch
+		for _, batch := range batches {
+			if batch.q == q && batch.table == table {
+				b = batch
+				break
+			}
+		}
+		if b == nil {
+			b = &insertBatch{q: q, table: table}
+			batches = append(batches, b)
+		}
+		b.rows = append(b.rows, i)
+
+		if u != nil {
+			// lookup entries of the row an upsert may update
+			key := u.conflict[0]
+			value := reflect.Indirect(ind.FieldByName(model.c2n[key])).Interface()
+			if olds[i], err = o.readLookups(ctx, q, table, model, model.lookups, key, value); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+
+	sep := fmt.Sprintf("%s, %s", TableQuote, TableQuote)
+	columns := TableQuote + strings.Join(cols, sep) + TableQuote
+	marks := "(" + strings.TrimRight(strings.Repeat(PrepareDelim+ColumnDelim+" ", len(cols)), ColumnDelim+" ") + ")"
+	var tail string
+	if u != nil {
+		tail = u.clause(model, cols, o.topo.strategy(model) != nil)
+	}
+
+	var affected int64
+	for _, b := range batches {
+		head := fmt.Sprintf("INSERT INTO %s%s%s (%s) VALUES ", TableQuote, b.table, TableQuote, columns)
+		for start := 0; start < len(b.rows); {
+			size := len(head) + len(tail)
+			end := start
+			for end < len(b.rows) && end-start < batchSize {
+				n := len(marks) + 2
+				for _, v := range rows[b.rows[end]] {
+					n += argSize(v)
+				}
+				if end > start && size+n > InsertMultiMaxBytes {
+					break
+				}
+				size += n
+				end++
+			}
+
+			chunk := b.rows[start:end]
+			values := make([]string, len(chunk))
+			args := make([]interface{}, 0, len(chunk)*len(cols))
+			for k, i := range chunk {
+				// lookup entries go first as in Insert
+				if err = o.insertLookups(ctx, mds[i], model); err != nil {
+					return affected, nil, err
+				}
+				values[k] = marks
+				args = append(args, rows[i]...)
+			}
+			query := head + strings.Join(values, ", ") + tail
+			res, err := o.execWrite(ctx, model, b.q, query, args...)
+			if err != nil {
+				return affected, nil, err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return affected, nil, err
+			}
+			affected += n
+			if len(model.auto) == 0 || (u != nil && len(chunk) == 1) {
+				// ids of a multi-row upsert are unknown
+				id, err := res.LastInsertId()
+				if err != nil {
+					return affected, nil, err
+				}
+				if u == nil {
+					for k, i := range chunk {
+						ids[i] = id + int64(k)
+					}
+				} else if len(chunk) == 1 && id > 0 && id != ids[chunk[0]] {
+					// the row existed, the generated id is unused
+					i := chunk[0]
+					ids[i] = id
+					if len(model.auto) > 0 {
+						setAutoId(mds[i], model, id)
+						for k, column := range cols {
+							if column == model.pk {
+								rows[i][k] = reflect.Indirect(reflect.Indirect(reflect.ValueOf(mds[i])).FieldByName(model.c2n[column])).Interface()
+							}
+						}
+					}
+				}
+			}
+
+			for _, i := range chunk {
+				o.shadowInsert(ctx, mds[i], model, b.table, cols, rows[i], ids[i], tail)
+				if err = o.deleteLookups(ctx, model, staleLookups(mds[i], model, olds[i])); err != nil {
+					return affected, nil, err
+				}
+			}
+			start = end
+		}
+	}
+	return affected, ids, nil
+}
+
+// pointers to the models in slice, a slice of model or pointer of model
+func (o *orm) sliceModels(slice interface{}) ([]interface{}, *modelInfo, error) {
+	val := reflect.Indirect(reflect.ValueOf(slice))
+	if val.Kind() != reflect.Slice {
+		return nil, nil, fmt.Errorf("<orm.InsertMulti> slice must be slice of model")
+	}
+	if val.Len() == 0 {
+		return nil, nil, nil
+	}
+	mds := make([]interface{}, val.Len())
+	for i := range mds {
+		v := val.Index(i)
+		if v.Kind() != reflect.Ptr {
+			v = v.Addr()
+		}
+		mds[i] = v.Interface()
+	}
+	fullName := getFullName(mds[0])
+	model, ok := o.topo.models[fullName]
+	if !ok {
+		return nil, nil, fmt.Errorf("<orm.InsertMulti> unknown model name `%s`", fullName)
+	}
+	return mds, model, nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// approximate bytes of an arg in the statement sent to server
+func argSize(v interface{}) int {
+	switch s := v.(type) {
+	case string:
+		return len(s) + 2
+	case []byte:
+		return len(s) + 2
+	}
+	return 20
+}
@@ -0,0 +1,413 @@
+package sharding
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// shard topology, loaded from a YAML or JSON file by LoadConfig:
+//   databases:
+//     - alias: db0
+//       dsn: user:pwd@tcp(10.0.0.1:3306)/shop
+//       max_idle: 10
+//       max_open: 100
+//       max_lifetime: 1h
+//       replicas: [user:pwd@tcp(10.0.0.2:3306)/shop]
+//   models:
+//     - table: order
+//       strategy: mod
+//       tables: 16
+//       aliases: [db0, db1]
+type Config struct {
+	DataBases []DataBaseConfig `json:"databases" yaml:"databases"`
+	Models    []ModelConfig    `json:"models" yaml:"models"`
+}
+
+// a db alias and its connection pool, zero pool size keeps the default
+type DataBaseConfig struct {
+	Alias       string   `json:"alias" yaml:"alias"`
+	DSN         string   `json:"dsn" yaml:"dsn"`
+	MaxIdle     int      `json:"max_idle" yaml:"max_idle"`
+	MaxOpen     int      `json:"max_open" yaml:"max_open"`
+	MaxLifetime string   `json:"max_lifetime" yaml:"max_lifetime"`
+	Replicas    []string `json:"replicas" yaml:"replicas"`
+}
+
+// sharding rule of the model whose table is Table, strategy is one of
+// mod, hash, range, date, bucket, ring, broadcast and bind
+type ModelConfig struct {
+	Table    string `json:"table" yaml:"table"`
+	Strategy string `json:"strategy" yaml:"strategy"`
+	// mod, hash, ring
+	Tables int `json:"tables" yaml:"tables"`
+	// mod, hash, broadcast
+	Aliases []string `json:"aliases" yaml:"aliases"`
+	// hash: crc32 or murmur3
+	Hash string `json:"hash" yaml:"hash"`
+	// range
+	Ranges []Range `json:"ranges" yaml:"ranges"`
+	// date: daily or monthly, Start and End are formatted as DateLayouts
+	Bucket   string `json:"bucket" yaml:"bucket"`
+	Location string `json:"location" yaml:"location"`
+	Start    string `json:"start" yaml:"start"`
+	End      string `json:"end" yaml:"end"`
+	// date, bucket: alias of tables, bucket: alias of config table
+	Alias string `json:"alias" yaml:"alias"`
+	// bucket
+	Buckets     int    `json:"buckets" yaml:"buckets"`
+	BucketTable string `json:"bucket_table" yaml:"bucket_table"`
+	// ring: virtual nodes per weight and alias => weight
+	Replicas int            `json:"replicas" yaml:"replicas"`
+	Nodes    map[string]int `json:"nodes" yaml:"nodes"`
+	// bind: table of parent model, shard key values are the same
+	Parent string `json:"parent" yaml:"parent"`
+}
+
+//read the topology file, .json is read as JSON and others as YAML, then
+//register every db alias and the models in mds with their rules.
+//a model without rule is registered unsharded
+func LoadConfig(path string, mds ...interface{}) error {
+	return defaultRegistry.LoadConfig(path, mds...)
+}
+
+func (r *Registry) LoadConfig(path string, mds ...interface{}) error {
+	c, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	return r.RegisterConfig(c, mds...)
+}
+
+func readConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("<sharding.Config> read `%s`, %s", path, err.Error())
+	}
+	c := new(Config)
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	} else {
+		err = yaml.UnmarshalStrict(data, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("<sharding.Config> parse `%s`, %s", path, err.Error())
+	}
+	return c, nil
+}
+
+// register config to the default registry, see Registry.RegisterConfig
+func (c *Config) Register(mds ...interface{}) error {
+	return defaultRegistry.RegisterConfig(c, mds...)
+}
+
+// validate the config, open and ping every db then register them all at
+// once, nothing is registered on failure
+func (r *Registry) RegisterConfig(c *Config, mds ...interface{}) error {
+	cur := r.load()
+	tables := make(map[string]string, len(mds))
+	for _, md := range mds {
+		table := getTableName(md)
+		if _, ok := tables[table]; ok {
+			return fmt.Errorf("<sharding.Config> model table `%s` repeat", table)
+		}
+		if _, ok := cur.models[getFullName(md)]; ok {
+			return fmt.Errorf("<sharding.Config> model `%s` have been registered", getFullName(md))
+		}
+		tables[table] = getFullName(md)
+	}
+	for _, dc := range c.DataBases {
+		if _, ok := cur.dbs[dc.Alias]; ok {
+			return fmt.Errorf("<sharding.Config> database alias `%s` have been registered", dc.Alias)
+		}
+	}
+	if err := c.validate(tables, cur.dbs); err != nil {
+		return err
+	}
+	strategies := make(map[string]ShardStrategy, len(c.Models))
+	for _, mc := range c.Models {
+		s, err := mc.strategy(tables)
+		if err != nil {
+			return fmt.Errorf("<sharding.Config> model `%s`, %s", mc.Table, err.Error())
+		}
+		strategies[mc.Table] = s
+	}
+	models := make([]*modelInfo, len(mds))
+	for i, md := range mds {
+		m, err := parseModel(md, strategies[getTableName(md)])
+		if err != nil {
+			return err
+		}
+		models[i] = m
+	}
+
+	dbs := make(map[string]*sql.DB, len(c.DataBases))
+	replicas := make(map[string]*replicaSet, len(c.DataBases))
+	var opened []*sql.DB
+	for _, dc := range c.DataBases {
+		db, err := dc.open(dc.DSN)
+		if err != nil {
+			closeAll(opened)
+			return err
+		}
+		opened = append(opened, db)
+		dbs[dc.Alias] = db
+
+		set, added, err := dc.replicas(nil)
+		if err != nil {
+			closeAll(opened)
+			return err
+		}
+		opened = append(opened, added...)
+		if set != nil {
+			replicas[dc.Alias] = set
+		}
+	}
+
+	err := r.update(func(t *topology) error {
+		for _, dc := range c.DataBases {
+			if _, ok := t.dbs[dc.Alias]; ok {
+				return fmt.Errorf("<sharding.Config> database alias `%s` have been registered", dc.Alias)
+			}
+			t.dbs[dc.Alias], t.dsns[dc.Alias] = dbs[dc.Alias], dc.DSN
+			if set, ok := replicas[dc.Alias]; ok {
+				t.replicas[dc.Alias] = set
+			}
+		}
+		for _, m := range models {
+			var err error
+			if s, ok := strategies[m.table]; ok {
+				err = r.addModel(t, m, s)
+			} else {
+				err = r.addModel(t, m)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		closeAll(opened)
+	}
+	return err
+}
+
+// open a db of alias with its pool settings
+func (dc DataBaseConfig) open(dsn string) (*sql.DB, error) {
+	db, err := openDataBase(dc.Alias, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("<sharding.Config> %s", err.Error())
+	}
+	dc.pool(db)
+	return db, nil
+}
+
+// replicas of alias, the ones of old with the same dsn are kept and the
+// others opened. opened are the new dbs, closed on error
+func (dc DataBaseConfig) replicas(old *replicaSet) (set *replicaSet, opened []*sql.DB, err error) {
+	if len(dc.Replicas) == 0 {
+		return nil, nil, nil
+	}
+	set = new(replicaSet)
+	for _, dsn := range dc.Replicas {
+		var (
+			db  *sql.DB
+			lag int64
+		)
+		if old != nil {
+			for i := range old.dsns {
+				if old.dsns[i] == dsn {
+					db, lag = old.dbs[i], int64(old.lag(i))
+					dc.pool(db)
+				}
+			}
+		}
+		if db == nil {
+			if db, err = dc.open(dsn); err != nil {
+				closeAll(opened)
+				return nil, nil, err
+			}
+			opened = append(opened, db)
+		}
+		set = set.add(db, dsn, lag)
+	}
+	return set, opened, nil
+}
+
+func (dc DataBaseConfig) pool(db *sql.DB) {
+	if dc.MaxIdle > 0 {
+		db.SetMaxIdleConns(dc.MaxIdle)
+	}
+	if dc.MaxOpen > 0 {
+		db.SetMaxOpenConns(dc.MaxOpen)
+	}
+	if len(dc.MaxLifetime) > 0 {
+		d, _ := time.ParseDuration(dc.MaxLifetime)
+		db.SetConnMaxLifetime(d)
+	}
+}
+
+// tables maps table name to model full name, dbs are the aliases usable
+// besides the ones in config
+func (c *Config) validate(tables map[string]string, dbs map[string]*sql.DB) error {
+	aliases := make(map[string]bool, len(c.DataBases))
+	for i, dc := range c.DataBases {
+		if len(dc.Alias) == 0 {
+			return fmt.Errorf("<sharding.Config> database %d has no alias", i)
+		}
+		if aliases[dc.Alias] {
+			return fmt.Errorf("<sharding.Config> database alias `%s` repeat", dc.Alias)
+		}
+		if len(dc.DSN) == 0 {
+			return fmt.Errorf("<sharding.Config> database `%s` has no dsn", dc.Alias)
+		}
+		if dc.MaxIdle < 0 || dc.MaxOpen < 0 {
+			return fmt.Errorf("<sharding.Config> database `%s` pool size must not be negative", dc.Alias)
+		}
+		if len(dc.MaxLifetime) > 0 {
+			if _, err := time.ParseDuration(dc.MaxLifetime); err != nil {
+				return fmt.Errorf("<sharding.Config> database `%s` max_lifetime, %s", dc.Alias, err.Error())
+			}
+		}
+		for _, dsn := range dc.Replicas {
+			if len(dsn) == 0 {
+				return fmt.Errorf("<sharding.Config> database `%s` has empty replica dsn", dc.Alias)
+			}
+		}
+		aliases[dc.Alias] = true
+	}
+
+	known := func(alias string) bool {
+		_, ok := dbs[alias]
+		return aliases[alias] || ok
+	}
+	rules := make(map[string]bool, len(c.Models))
+	for _, mc := range c.Models {
+		if _, ok := tables[mc.Table]; !ok {
+			return fmt.Errorf("<sharding.Config> model table `%s` not given", mc.Table)
+		}
+		if rules[mc.Table] {
+			return fmt.Errorf("<sharding.Config> model table `%s` repeat", mc.Table)
+		}
+		rules[mc.Table] = true
+
+		used := append([]string{mc.Alias}, mc.Aliases...)
+		for _, r := range mc.Ranges {
+			used = append(used, r.Alias)
+		}
+		for alias := range mc.Nodes {
+			used = append(used, alias)
+		}
+		for _, alias := range used {
+			if len(alias) > 0 && !known(alias) {
+				return fmt.Errorf("<sharding.Config> model `%s` unknown db alias `%s`", mc.Table, alias)
+			}
+		}
+	}
+	return nil
+}
+
+// build the strategy of rule, tables maps table name to model full name
+func (mc ModelConfig) strategy(tables map[string]string) (s ShardStrategy, err error) {
+	// constructors panic on invalid arguments
+	defer func() {
+		if r := recover(); r != nil {
+			s, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	switch strings.ToLower(mc.Strategy) {
+	case "mod":
+		return NewModStrategy(mc.Tables, mc.Aliases...), nil
+	case "hash":
+		hash := HashCRC32
+		switch strings.ToLower(mc.Hash) {
+		case "", "crc32":
+		case "murmur3":
+			hash = HashMurmur3
+		default:
+			return nil, fmt.Errorf("unknown hash `%s`", mc.Hash)
+		}
+		return NewHashStrategy(mc.Tables, hash, mc.Aliases...), nil
+	case "range":
+		if len(mc.Ranges) == 0 {
+			return nil, fmt.Errorf("no ranges")
+		}
+		return NewRangeStrategy(mc.Ranges...), nil
+	case "date":
+		bucket := DateDaily
+		switch strings.ToLower(mc.Bucket) {
+		case "", "daily":
+		case "monthly":
+			bucket = DateMonthly
+		default:
+			return nil, fmt.Errorf("unknown bucket `%s`", mc.Bucket)
+		}
+		ds := NewDateStrategy(bucket)
+		ds.Alias = mc.Alias
+		if len(mc.Location) > 0 {
+			if ds.Location, err = time.LoadLocation(mc.Location); err != nil {
+				return nil, err
+			}
+		}
+		if len(mc.Start) > 0 {
+			if ds.Start, err = ds.time(mc.Start); err != nil {
+				return nil, err
+			}
+		}
+		if len(mc.End) > 0 {
+			if ds.End, err = ds.time(mc.End); err != nil {
+				return nil, err
+			}
+		}
+		return ds, nil
+	case "bucket":
+		if len(mc.Alias) == 0 || len(mc.BucketTable) == 0 {
+			return nil, fmt.Errorf("bucket needs alias and bucket_table")
+		}
+		return NewBucketStrategy(mc.Buckets, mc.Alias, mc.BucketTable), nil
+	case "ring":
+		if len(mc.Nodes) == 0 {
+			return nil, fmt.Errorf("ring has no nodes")
+		}
+		r := NewHashRing(mc.Replicas, mc.Tables)
+		for alias, weight := range mc.Nodes {
+			if err = r.AddNode(alias, weight); err != nil {
+				return nil, err
+			}
+		}
+		return r, nil
+	case "broadcast":
+		return NewBroadcast(mc.Aliases...), nil
+	case "bind":
+		parent, ok := tables[mc.Parent]
+		if !ok || len(parent) == 0 {
+			return nil, fmt.Errorf("unknown parent table `%s`", mc.Parent)
+		}
+		return &BindStrategy{parent: parent}, nil
+	}
+	return nil, fmt.Errorf("unknown strategy `%s`", mc.Strategy)
+}
+
+// newModelInfo returning its panic as error
+func parseModel(md interface{}, strategy ShardStrategy) (m *modelInfo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	if strategy == nil {
+		return newModelInfo(md), nil
+	}
+	return newModelInfo(md, strategy), nil
+}
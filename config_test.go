@@ -0,0 +1,132 @@
+package sharding
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tables := map[string]string{"order": "main.Order", "item": "main.Item"}
+	dbs := map[string]*sql.DB{"meta": nil}
+	db := func(alias string) DataBaseConfig {
+		return DataBaseConfig{Alias: alias, DSN: "user:pwd@tcp(127.0.0.1:3306)/" + alias}
+	}
+	cases := []struct {
+		c   Config
+		err string
+	}{
+		{Config{
+			DataBases: []DataBaseConfig{db("db0"), db("db1")},
+			Models: []ModelConfig{
+				{Table: "order", Strategy: "mod", Tables: 4, Aliases: []string{"db0", "db1"}},
+				{Table: "item", Strategy: "bucket", Alias: "meta"},
+			},
+		}, ""},
+		{Config{DataBases: []DataBaseConfig{{DSN: "dsn"}}}, "has no alias"},
+		{Config{DataBases: []DataBaseConfig{db("db0"), db("db0")}}, "repeat"},
+		{Config{DataBases: []DataBaseConfig{{Alias: "db0"}}}, "has no dsn"},
+		{Config{DataBases: []DataBaseConfig{{Alias: "db0", DSN: "dsn", MaxOpen: -1}}}, "must not be negative"},
+		{Config{DataBases: []DataBaseConfig{{Alias: "db0", DSN: "dsn", MaxLifetime: "1 hour"}}}, "max_lifetime"},
+		{Config{DataBases: []DataBaseConfig{{Alias: "db0", DSN: "dsn", Replicas: []string{""}}}}, "empty replica dsn"},
+		{Config{Models: []ModelConfig{{Table: "user", Strategy: "mod"}}}, "not given"},
+		{Config{Models: []ModelConfig{{Table: "order", Strategy: "mod"}, {Table: "order", Strategy: "hash"}}}, "repeat"},
+		{Config{Models: []ModelConfig{{Table: "order", Strategy: "mod", Aliases: []string{"db9"}}}}, "unknown db alias `db9`"},
+		{Config{Models: []ModelConfig{{Table: "order", Strategy: "date", Alias: "db9"}}}, "unknown db alias `db9`"},
+		{Config{Models: []ModelConfig{{Table: "order", Strategy: "range", Ranges: []Range{{Start: 0, End: 1, Alias: "db9"}}}}}, "unknown db alias `db9`"},
+		{Config{Models: []ModelConfig{{Table: "order", Strategy: "ring", Nodes: map[string]int{"db9": 1}}}}, "unknown db alias `db9`"},
+	}
+	for i, c := range cases {
+		err := c.c.validate(tables, dbs)
+		if len(c.err) == 0 {
+			if err != nil {
+				t.Errorf("case %d: %v", i, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("case %d: err %v, want %s", i, err, c.err)
+		}
+	}
+}
+
+func TestModelConfigStrategy(t *testing.T) {
+	tables := map[string]string{"order": "main.Order", "item": "main.Item", "log": ""}
+	cases := []struct {
+		mc    ModelConfig
+		check func(s ShardStrategy) bool
+		err   string
+	}{
+		{ModelConfig{Strategy: "mod", Tables: 4, Aliases: []string{"db0"}}, func(s ShardStrategy) bool {
+			m, ok := s.(*ModStrategy)
+			return ok && m.Tables == 4 && len(m.Aliases) == 1
+		}, ""},
+		{ModelConfig{Strategy: "MOD"}, nil, "tables must be positive"},
+		{ModelConfig{Strategy: "hash", Tables: 2}, func(s ShardStrategy) bool {
+			h, ok := s.(*HashStrategy)
+			return ok && h.Hash == HashCRC32
+		}, ""},
+		{ModelConfig{Strategy: "hash", Tables: 2, Hash: "Murmur3"}, func(s ShardStrategy) bool {
+			h, ok := s.(*HashStrategy)
+			return ok && h.Hash == HashMurmur3
+		}, ""},
+		{ModelConfig{Strategy: "hash", Tables: 2, Hash: "md5"}, nil, "unknown hash"},
+		{ModelConfig{Strategy: "range", Ranges: []Range{{Start: 0, End: 10, Suffix: "0"}}}, func(s ShardStrategy) bool {
+			r, ok := s.(*RangeStrategy)
+			return ok && len(r.Ranges) == 1
+		}, ""},
+		{ModelConfig{Strategy: "range"}, nil, "no ranges"},
+		{ModelConfig{Strategy: "range", Ranges: []Range{{Start: 10, End: 10}}}, nil, "start must less than end"},
+		{ModelConfig{Strategy: "date", Bucket: "monthly", Alias: "db0", Location: "UTC", Start: "2020-01-01", End: "2020-06-30 12:00:00"}, func(s ShardStrategy) bool {
+			d, ok := s.(*DateStrategy)
+			return ok && d.Bucket == DateMonthly && d.Alias == "db0" && d.Location == time.UTC &&
+				d.Start.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) &&
+				d.End.Equal(time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC))
+		}, ""},
+		{ModelConfig{Strategy: "date"}, func(s ShardStrategy) bool {
+			d, ok := s.(*DateStrategy)
+			return ok && d.Bucket == DateDaily && d.Start.IsZero()
+		}, ""},
+		{ModelConfig{Strategy: "date", Bucket: "weekly"}, nil, "unknown bucket"},
+		{ModelConfig{Strategy: "date", Location: "Nowhere/City"}, nil, "unknown time zone"},
+		{ModelConfig{Strategy: "date", Start: "2020/01/01"}, nil, "unknown date format"},
+		{ModelConfig{Strategy: "bucket", Buckets: 16, Alias: "meta", BucketTable: "order_bucket"}, func(s ShardStrategy) bool {
+			b, ok := s.(*BucketStrategy)
+			return ok && b.buckets == 16 && b.alias == "meta" && b.table == "order_bucket"
+		}, ""},
+		{ModelConfig{Strategy: "bucket", Buckets: 16, Alias: "meta"}, nil, "needs alias and bucket_table"},
+		{ModelConfig{Strategy: "bucket", Alias: "meta", BucketTable: "order_bucket"}, nil, "buckets must be positive"},
+		{ModelConfig{Strategy: "ring", Replicas: 10, Nodes: map[string]int{"db0": 1, "db1": 2}}, func(s ShardStrategy) bool {
+			r, ok := s.(*HashRing)
+			return ok && len(r.weights) == 2 && r.weights["db1"] == 2
+		}, ""},
+		{ModelConfig{Strategy: "ring", Replicas: 10}, nil, "no nodes"},
+		{ModelConfig{Strategy: "ring", Nodes: map[string]int{"db0": 1}}, nil, "replicas must be positive"},
+		{ModelConfig{Strategy: "ring", Replicas: 10, Nodes: map[string]int{"db0": 0}}, nil, "weight"},
+		{ModelConfig{Strategy: "broadcast", Aliases: []string{"db0", "db1"}}, func(s ShardStrategy) bool {
+			b, ok := s.(*BroadcastStrategy)
+			return ok && len(b.Aliases) == 2
+		}, ""},
+		{ModelConfig{Strategy: "bind", Parent: "order"}, func(s ShardStrategy) bool {
+			b, ok := s.(*BindStrategy)
+			return ok && b.parent == "main.Order"
+		}, ""},
+		{ModelConfig{Strategy: "bind", Parent: "user"}, nil, "unknown parent table"},
+		// table of several models
+		{ModelConfig{Strategy: "bind", Parent: "log"}, nil, "unknown parent table"},
+		{ModelConfig{Strategy: "shuffle"}, nil, "unknown strategy"},
+	}
+	for i, c := range cases {
+		s, err := c.mc.strategy(tables)
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("case %d: err %v, want %s", i, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+		} else if !c.check(s) {
+			t.Errorf("case %d: unexpected strategy %#v", i, s)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package sharding
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	SnowflakeEpoch   = int64(1577836800000) // 2020-01-01 00:00:00 UTC in ms
+	SnowflakeWorkers = 1 << 10
+	snowflakeSeqBits = 12
+	snowflakeSeqMask = 1<<snowflakeSeqBits - 1
+)
+
+// generator of distributed ids, key is the logical table of model
+type IdGenerator interface {
+	NextId(key string) (int64, error)
+}
+
+//register id generator used by model tagged with `pk;auto(name)`
+func RegisterIdGenerator(name string, g IdGenerator) error {
+	return defaultRegistry.RegisterIdGenerator(name, g)
+}
+
+func (r *Registry) RegisterIdGenerator(name string, g IdGenerator) error {
+	return r.update(func(t *topology) error {
+		if _, ok := t.idgens[name]; ok {
+			return fmt.Errorf("id generator `%s` have been registered", name)
+		}
+		t.idgens[name] = r.bind(g).(IdGenerator)
+		return nil
+	})
+}
+
+// fill the auto pk of model instance when it is zero
+func (o *orm) generateId(md interface{}, model *modelInfo) (int64, error) {
+	if len(model.auto) == 0 {
+		return 0, nil
+	}
+
+	fi := model.fields[model.pk]
+	field := reflect.Indirect(reflect.Indirect(reflect.ValueOf(md)).FieldByName(fi.name))
+	switch v := field.Interface().(type) {
+	case int64:
+		if v != 0 {
+			return v, nil
+		}
+	case uint64:
+		if v != 0 {
+			return int64(v), nil
+		}
+	}
+
+	g, ok := o.topo.idgens[model.auto]
+	if !ok {
+		return 0, fmt.Errorf("<orm.Insert> unknown id generator `%s`", model.auto)
+	}
+	id, err := g.NextId(model.table)
+	if err != nil {
+		return 0, err
+	}
+	setAutoId(md, model, id)
+	return id, nil
+}
+
+// set the auto pk of model instance
+func setAutoId(md interface{}, model *modelInfo, id int64) {
+	fi := model.fields[model.pk]
+	field := reflect.Indirect(reflect.Indirect(reflect.ValueOf(md)).FieldByName(fi.name))
+	if fi.fieldType == TypePositiveBigIntegerField {
+		setFieldValue(fi, uint64(id), field)
+	} else {
+		setFieldValue(fi, id, field)
+	}
+}
+
+// snowflake id: 41 bits ms since SnowflakeEpoch, 10 bits worker, 12 bits sequence
+type Snowflake struct {
+	mu       sync.Mutex
+	workerId int64
+	lastMs   int64
+	seq      int64
+}
+
+func NewSnowflake(workerId int64) (*Snowflake, error) {
+	if workerId < 0 || workerId >= SnowflakeWorkers {
+		return nil, fmt.Errorf("<sharding.NewSnowflake> worker id must in [0, %d)", SnowflakeWorkers)
+	}
+	return &Snowflake{workerId: workerId}, nil
+}
+
+func (s *Snowflake) NextId(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	if ms < s.lastMs {
+		return 0, fmt.Errorf("<Snowflake> clock moved backwards %dms", s.lastMs-ms)
+	}
+	if ms == s.lastMs {
+		s.seq = (s.seq + 1) & snowflakeSeqMask
+		if s.seq == 0 {
+			for ms <= s.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				ms = time.Now().UnixNano() / int64(time.Millisecond)
+			}
+		}
+	} else {
+		s.seq = 0
+	}
+	s.lastMs = ms
+	return (ms-SnowflakeEpoch)<<(snowflakeSeqBits+10) | s.workerId<<snowflakeSeqBits | s.seq, nil
+}
+
+// segment allocator, every key takes ids in segments of step from a ticket
+// table on alias:
+//   CREATE TABLE `table` (`biz_tag` VARCHAR(128) PRIMARY KEY, `max_id` BIGINT NOT NULL)
+type Segment struct {
+	mu    sync.Mutex
+	alias string
+	table string
+	step  int64
+	segs  map[string]*[2]int64
+	reg   *Registry
+}
+
+func NewSegment(alias, table string, step int64) (*Segment, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("<sharding.NewSegment> step must be positive")
+	}
+	return &Segment{alias: alias, table: table, step: step, segs: make(map[string]*[2]int64)}, nil
+}
+
+func (s *Segment) NextId(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seg, ok := s.segs[key]
+	if !ok || seg[0] >= seg[1] {
+		max, err := s.fetch(key)
+		if err != nil {
+			return 0, err
+		}
+		seg = &[2]int64{max - s.step, max}
+		s.segs[key] = seg
+	}
+	seg[0]++
+	return seg[0], nil
+}
+
+func (s *Segment) bindRegistry(r *Registry) {
+	s.mu.Lock()
+	s.reg = r
+	s.mu.Unlock()
+}
+
+// take the next segment of key, return the max id of it
+func (s *Segment) fetch(key string) (int64, error) {
+	db, ok := registryOf(s.reg).load().dbs[s.alias]
+	if !ok {
+		return 0, fmt.Errorf("<Segment> unknown db alias name `%s`", s.alias)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var max int64
+	query := fmt.Sprintf("INSERT INTO %s%s%s (`biz_tag`, `max_id`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `max_id` = `max_id` + ?", TableQuote, s.table, TableQuote)
+	if _, err = tx.Exec(query, key, s.step, s.step); err == nil {
+		query = fmt.Sprintf("SELECT `max_id` FROM %s%s%s WHERE `biz_tag` = ?", TableQuote, s.table, TableQuote)
+		err = tx.QueryRow(query, key).Scan(&max)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return max, tx.Commit()
+}
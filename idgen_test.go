@@ -0,0 +1,90 @@
+package sharding
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewSnowflake(t *testing.T) {
+	cases := []struct {
+		workerId int64
+		err      bool
+	}{
+		{0, false},
+		{SnowflakeWorkers - 1, false},
+		{-1, true},
+		{SnowflakeWorkers, true},
+	}
+	for _, c := range cases {
+		if _, err := NewSnowflake(c.workerId); (err != nil) != c.err {
+			t.Errorf("NewSnowflake(%d) err %v", c.workerId, err)
+		}
+	}
+}
+
+func TestSnowflakeNextId(t *testing.T) {
+	for _, workerId := range []int64{0, 1, 513, SnowflakeWorkers - 1} {
+		s, _ := NewSnowflake(workerId)
+		before := time.Now().UnixNano()/int64(time.Millisecond) - SnowflakeEpoch
+		// more ids than one ms of sequence, so the sequence wraps
+		n := 3 * (snowflakeSeqMask + 1)
+		last := int64(-1)
+		for i := 0; i < n; i++ {
+			id, err := s.NextId("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id <= last {
+				t.Fatalf("worker %d: id %d after %d is not increasing", workerId, id, last)
+			}
+			last = id
+			if w := id >> snowflakeSeqBits & (SnowflakeWorkers - 1); w != workerId {
+				t.Fatalf("worker %d: id %d has worker bits %d", workerId, id, w)
+			}
+		}
+		after := time.Now().UnixNano()/int64(time.Millisecond) - SnowflakeEpoch
+		if ms := last >> (snowflakeSeqBits + 10); ms < before || ms > after {
+			t.Errorf("worker %d: id %d has ms %d out of [%d, %d]", workerId, last, ms, before, after)
+		}
+	}
+}
+
+func TestSnowflakeConcurrent(t *testing.T) {
+	s, _ := NewSnowflake(7)
+	const goroutines, each = 8, 2000
+	ids := make(chan int64, goroutines*each)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				id, err := s.NextId("")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int64]bool, goroutines*each)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("id %d repeat", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestSnowflakeClockBackwards(t *testing.T) {
+	s, _ := NewSnowflake(0)
+	s.lastMs = time.Now().UnixNano()/int64(time.Millisecond) + 1000
+	if _, err := s.NextId(""); err == nil {
+		t.Error("NextId should fail when the clock moved backwards")
+	}
+}
@@ -1,21 +1,73 @@
 package sharding
 
 import (
+	"context"
 	"database/sql"
+	"time"
 )
 
 type Eorm interface {
 	Read(md interface{}, cols ...string) error
+	ReadContext(ctx context.Context, md interface{}, cols ...string) error
+	ReadMulti(res interface{}, keys interface{}, col ...string) error
+	ReadMultiContext(ctx context.Context, res interface{}, keys interface{}, col ...string) error
 	Insert(md interface{}) (int64, error)
+	InsertContext(ctx context.Context, md interface{}) (int64, error)
+	InsertMulti(batchSize int, slice interface{}) (int64, []int64, error)
+	InsertMultiContext(ctx context.Context, batchSize int, slice interface{}) (int64, []int64, error)
+	InsertOrUpdate(md interface{}, conflictCols ...string) (int64, error)
+	InsertOrUpdateContext(ctx context.Context, md interface{}, conflictCols ...string) (int64, error)
+	InsertOrUpdateMulti(batchSize int, slice interface{}, conflictCols ...string) (int64, error)
+	InsertOrUpdateMultiContext(ctx context.Context, batchSize int, slice interface{}, conflictCols ...string) (int64, error)
 	Update(md interface{}, cols ...string) (int64, error)
+	UpdateContext(ctx context.Context, md interface{}, cols ...string) (int64, error)
 	Delete(md interface{}) (int64, error)
+	DeleteContext(ctx context.Context, md interface{}) (int64, error)
+	UpdateWhere(md interface{}, values map[string]interface{}, conds ...Cond) (int64, error)
+	UpdateWhereContext(ctx context.Context, md interface{}, values map[string]interface{}, conds ...Cond) (int64, error)
+	DeleteWhere(md interface{}, conds ...Cond) (int64, error)
+	DeleteWhereContext(ctx context.Context, md interface{}, conds ...Cond) (int64, error)
 	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
     Query2Obj(res interface{},query string, args ...interface{}) error
+	Query2ObjContext(ctx context.Context, res interface{}, query string, args ...interface{}) error
+	Query2ObjAll(res interface{}, query string, args ...interface{}) error
+	Query2ObjAllContext(ctx context.Context, res interface{}, query string, args ...interface{}) error
+	AggregateAll(md interface{}, query string, args ...interface{}) ([]interface{}, error)
+	AggregateAllContext(ctx context.Context, md interface{}, query string, args ...interface{}) ([]interface{}, error)
 	Using(name string) error
 	Begin() error
+	BeginTx(ctx context.Context, opts *sql.TxOptions) error
+	BeginXA() error
 	Commit() error
 	Rollback() error
+	Primary() Eorm
+	ReadYourWrites(window time.Duration)
+	QueryTable(md interface{}) QuerySeter
+}
+
+// chainable query of a registered model, every method returns a new
+// QuerySeter so a partial query can be reused
+type QuerySeter interface {
+	Filter(expr string, args ...interface{}) QuerySeter
+	Exclude(expr string, args ...interface{}) QuerySeter
+	OrderBy(exprs ...string) QuerySeter
+	Limit(limit int64) QuerySeter
+	Offset(offset int64) QuerySeter
+	WithContext(ctx context.Context) QuerySeter
+	Count() (int64, error)
+	Exist() bool
+	All(res interface{}) (int64, error)
+	One(md interface{}) error
+}
+
+// common interface of db, transaction and connection
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 //db interface
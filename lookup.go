@@ -0,0 +1,225 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+//register the alias holding lookup tables of columns tagged with
+//`index_lookup(column)`, the table of a column is table_lookup_column:
+//  CREATE TABLE `order_lookup_order_no` (`lookup_key` VARCHAR(191) PRIMARY KEY, `shard_key` VARCHAR(191) NOT NULL)
+func RegisterLookupAlias(alias string) error {
+	return defaultRegistry.RegisterLookupAlias(alias)
+}
+
+func (r *Registry) RegisterLookupAlias(alias string) error {
+	return r.update(func(t *topology) error {
+		if _, ok := t.dbs[alias]; !ok {
+			return fmt.Errorf("<sharding.RegisterLookupAlias> unknown db alias name `%s`", alias)
+		}
+		t.lookupAlias = alias
+		return nil
+	})
+}
+
+func lookupTable(model *modelInfo, column string) string {
+	return model.table + "_lookup_" + column
+}
+
+func isLookup(model *modelInfo, column string) bool {
+	for _, c := range model.lookups {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup tables are written in the transaction of orm when it covers the
+// lookup alias, otherwise right after the write of model
+func (o *orm) lookupQuerier(ctx context.Context) (sqlQuerier, error) {
+	alias := o.topo.lookupAlias
+	if len(alias) == 0 {
+		return nil, fmt.Errorf("<orm> lookup alias not registered, call RegisterLookupAlias first")
+	}
+	if o.xa != nil || (o.isTx && o.aliasName == alias) {
+		return o.querier(ctx, alias)
+	}
+	return o.topo.dbs[alias], nil
+}
+
+// set the shard key of md from the lookup table when it is read by a
+// lookup column, so Read routes to the single shard holding the row
+func (o *orm) routeByLookup(ctx context.Context, md interface{}, model *modelInfo, column string) error {
+	if _, ok := model.c2n[column]; !ok {
+		column = model.n2c[column]
+	}
+	if o.topo.strategy(model) == nil || column == model.shard || !isLookup(model, column) {
+		return nil
+	}
+
+	q, err := o.lookupQuerier(ctx)
+	if err != nil {
+		return err
+	}
+	ind := reflect.Indirect(reflect.ValueOf(md))
+	value := reflect.Indirect(ind.FieldByName(model.c2n[column])).Interface()
+	query := fmt.Sprintf("SELECT `shard_key` FROM %s%s%s WHERE `lookup_key` = ?", TableQuote, lookupTable(model, column), TableQuote)
+
+	var shardKey string
+	if err = q.QueryRowContext(ctx, query, ToStr(value)).Scan(&shardKey); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNoRows
+		}
+		return err
+	}
+	fi := model.fields[model.shard]
+	setFieldValue(fi, convertValueFromDB(fi, shardKey), ind.FieldByName(fi.name))
+	return nil
+}
+
+// old values of the lookup columns in cols, read before update or delete
+func (o *orm) readLookups(ctx context.Context, q sqlQuerier, table string, model *modelInfo, cols []string, key string, keyValue interface{}) (map[string]string, error) {
+	if len(model.lookups) == 0 || o.topo.strategy(model) == nil {
+		return nil, nil
+	}
+	var lookups []string
+	for _, column := range cols {
+		if isLookup(model, column) {
+			lookups = append(lookups, column)
+		}
+	}
+	if len(lookups) == 0 {
+		return nil, nil
+	}
+
+	sep := fmt.Sprintf("%s, %s", TableQuote, TableQuote)
+	query := fmt.Sprintf("SELECT %s%s%s FROM %s%s%s WHERE %s%s%s = ?", TableQuote, strings.Join(lookups, sep), TableQuote, TableQuote, table, TableQuote, TableQuote, key, TableQuote)
+	vals := make([]sql.NullString, len(lookups))
+	refs := make([]interface{}, len(lookups))
+	for i := range vals {
+		refs[i] = &vals[i]
+	}
+	if err := q.QueryRowContext(ctx, query, keyValue).Scan(refs...); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	old := make(map[string]string, len(lookups))
+	for i, column := range lookups {
+		if vals[i].Valid {
+			old[column] = vals[i].String
+		}
+	}
+	return old, nil
+}
+
+// add the lookup entries of an inserted md, an entry of the value owned by
+// another shard key is refused so lookup values stay unique. an entry with
+// the same shard key, left by a failed insert, is kept
+func (o *orm) insertLookups(ctx context.Context, md interface{}, model *modelInfo) error {
+	if len(model.lookups) == 0 || o.topo.strategy(model) == nil {
+		return nil
+	}
+	q, err := o.lookupQuerier(ctx)
+	if err != nil {
+		return err
+	}
+	ind := reflect.Indirect(reflect.ValueOf(md))
+	shardKey := ToStr(shardValue(md, model))
+	for _, column := range model.lookups {
+		table := lookupTable(model, column)
+		value := ToStr(reflect.Indirect(ind.FieldByName(model.c2n[column])).Interface())
+		query := fmt.Sprintf("INSERT INTO %s%s%s (`lookup_key`, `shard_key`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `lookup_key` = `lookup_key`", TableQuote, table, TableQuote)
+		res, err := q.ExecContext(ctx, query, value, shardKey)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+
+		var owner string
+		query = fmt.Sprintf("SELECT `shard_key` FROM %s%s%s WHERE `lookup_key` = ?", TableQuote, table, TableQuote)
+		if err = q.QueryRowContext(ctx, query, value).Scan(&owner); err != nil {
+			return err
+		}
+		if owner != shardKey {
+			return fmt.Errorf("<orm> lookup value `%s` of `%s` is taken by shard key `%s`", value, column, owner)
+		}
+	}
+	return nil
+}
+
+// write the lookup entries of md, old entries with changed value are removed
+func (o *orm) saveLookups(ctx context.Context, md interface{}, model *modelInfo, cols []string, old map[string]string) error {
+	if len(model.lookups) == 0 || o.topo.strategy(model) == nil {
+		return nil
+	}
+	q, err := o.lookupQuerier(ctx)
+	if err != nil {
+		return err
+	}
+	ind := reflect.Indirect(reflect.ValueOf(md))
+	shardKey := ToStr(shardValue(md, model))
+	for _, column := range cols {
+		if !isLookup(model, column) {
+			continue
+		}
+		table := lookupTable(model, column)
+		value := ToStr(reflect.Indirect(ind.FieldByName(model.c2n[column])).Interface())
+		if v, ok := old[column]; ok && v != value {
+			query := fmt.Sprintf("DELETE FROM %s%s%s WHERE `lookup_key` = ?", TableQuote, table, TableQuote)
+			if _, err = q.ExecContext(ctx, query, v); err != nil {
+				return err
+			}
+		}
+		query := fmt.Sprintf("REPLACE INTO %s%s%s (`lookup_key`, `shard_key`) VALUES (?, ?)", TableQuote, table, TableQuote)
+		if _, err = q.ExecContext(ctx, query, value, shardKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entries of old whose lookup column of md has changed
+func staleLookups(md interface{}, model *modelInfo, old map[string]string) map[string]string {
+	if len(old) == 0 {
+		return nil
+	}
+	ind := reflect.Indirect(reflect.ValueOf(md))
+	stale := make(map[string]string, len(old))
+	for column, v := range old {
+		if v != ToStr(reflect.Indirect(ind.FieldByName(model.c2n[column])).Interface()) {
+			stale[column] = v
+		}
+	}
+	return stale
+}
+
+// remove the lookup entries in old, read before delete or changed by upsert
+func (o *orm) deleteLookups(ctx context.Context, model *modelInfo, old map[string]string) error {
+	if len(old) == 0 {
+		return nil
+	}
+	q, err := o.lookupQuerier(ctx)
+	if err != nil {
+		return err
+	}
+	for column, value := range old {
+		query := fmt.Sprintf("DELETE FROM %s%s%s WHERE `lookup_key` = ?", TableQuote, lookupTable(model, column), TableQuote)
+		if _, err = q.ExecContext(ctx, query, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
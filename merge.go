@@ -0,0 +1,560 @@
+package sharding
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ORDER BY column of a cross-shard query
+type orderBy struct {
+	column string
+	desc   bool
+}
+
+// ORDER BY and LIMIT of a cross-shard query, the LIMIT pushed down to each
+// shard is offset+limit and the global page is cut after merge
+type pagination struct {
+	orders   []orderBy
+	hasLimit bool
+	offset   int64
+	limit    int64
+}
+
+// parse ORDER BY/LIMIT of query and rewrite LIMIT for every shard
+func parsePagination(query string, args []interface{}) (string, []interface{}, *pagination, error) {
+	p := &pagination{}
+	toks := tokenize(query)
+
+	lim := findKeyword(toks, 0, "LIMIT")
+	end := lim
+	if end < 0 {
+		end = len(toks)
+	}
+	if ob := findKeyword(toks, 0, "ORDER"); ob >= 0 && ob < end {
+		by := nextToken(toks, ob)
+		if by < 0 || !toks[by].is("BY") {
+			return "", nil, nil, fmt.Errorf("<orm> bad ORDER BY in `%s`", query)
+		}
+		orderEnd := end
+		for _, kw := range []string{"FOR", "LOCK"} {
+			if i := findKeyword(toks, by, kw); i >= 0 && i < orderEnd {
+				orderEnd = i
+			}
+		}
+		orders, err := parseOrders(toks[by+1 : orderEnd])
+		if err != nil {
+			return "", nil, nil, err
+		}
+		p.orders = orders
+	}
+	if lim < 0 {
+		return query, args, p, nil
+	}
+
+	var (
+		values  []int64
+		argsPos []int
+		limEnd  = lim + 1
+	)
+	for i := nextToken(toks, lim); i >= 0; i = nextToken(toks, i) {
+		t := toks[i]
+		if t.text == "," || t.is("OFFSET") {
+			if t.is("OFFSET") {
+				values = append(values, -1)
+			}
+			continue
+		}
+		if t.kind != tokNumber && t.kind != tokArg {
+			break
+		}
+		text := t.text
+		if t.kind == tokArg {
+			pos := argIndex(toks, i)
+			if pos >= len(args) {
+				return "", nil, nil, ErrArgs
+			}
+			text = ToStr(args[pos])
+			argsPos = append(argsPos, pos)
+		}
+		v, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("<orm> bad LIMIT in `%s`", query)
+		}
+		values = append(values, v)
+		limEnd = i + 1
+	}
+
+	p.hasLimit = true
+	switch {
+	case len(values) == 1:
+		p.limit = values[0]
+	case len(values) == 2:
+		p.offset, p.limit = values[0], values[1]
+	case len(values) == 3 && values[1] == -1:
+		p.limit, p.offset = values[0], values[2]
+	default:
+		return "", nil, nil, fmt.Errorf("<orm> bad LIMIT in `%s`", query)
+	}
+
+	rest := make([]interface{}, 0, len(args))
+	for i, arg := range args {
+		if !hasInt(argsPos, i) {
+			rest = append(rest, arg)
+		}
+	}
+	rewrite := joinTokens(toks[:lim]) + "LIMIT " + strconv.FormatInt(p.offset+p.limit, 10) + joinTokens(toks[limEnd:])
+	return rewrite, rest, p, nil
+}
+
+// parse the items of ORDER BY, only plain columns are supported
+func parseOrders(toks []token) ([]orderBy, error) {
+	var orders []orderBy
+	for _, item := range splitTokens(toks, ",") {
+		var o orderBy
+		for _, t := range item {
+			switch {
+			case t.kind == tokSpace || t.text == ".":
+			case t.is("ASC"):
+			case t.is("DESC"):
+				o.desc = true
+			case t.kind == tokIdent || t.kind == tokQuoted:
+				o.column = t.name()
+			default:
+				return nil, fmt.Errorf("<orm> ORDER BY `%s` is not supported across shards", strings.TrimSpace(joinTokens(item)))
+			}
+		}
+		orders = append(orders, o)
+	}
+	return orders, nil
+}
+
+// merge results of shards sorted by orders, then cut the global page
+func mergeRows(parts [][]reflect.Value, m *modelInfo, p *pagination) ([]reflect.Value, error) {
+	var rows []reflect.Value
+	if len(p.orders) == 0 {
+		for _, part := range parts {
+			rows = append(rows, part...)
+		}
+	} else {
+		fields := make([]string, len(p.orders))
+		for i, o := range p.orders {
+			if name, ok := m.c2n[o.column]; ok {
+				fields[i] = name
+			} else if _, ok := m.n2c[o.column]; ok {
+				fields[i] = o.column
+			} else {
+				return nil, fmt.Errorf("<orm> unknown ORDER BY column `%s`", o.column)
+			}
+		}
+		h := &rowHeap{parts: parts, fields: fields, orders: p.orders}
+		for i, part := range parts {
+			if len(part) > 0 {
+				h.items = append(h.items, [2]int{i, 0})
+			}
+		}
+		heap.Init(h)
+		for h.Len() > 0 {
+			item := h.items[0]
+			rows = append(rows, parts[item[0]][item[1]])
+			if item[1]+1 < len(parts[item[0]]) {
+				h.items[0][1]++
+				heap.Fix(h, 0)
+			} else {
+				heap.Pop(h)
+			}
+		}
+	}
+
+	if p.hasLimit {
+		if p.offset >= int64(len(rows)) {
+			return nil, nil
+		}
+		rows = rows[p.offset:]
+		if p.limit < int64(len(rows)) {
+			rows = rows[:p.limit]
+		}
+	}
+	return rows, nil
+}
+
+// heap of the head row of every shard result
+type rowHeap struct {
+	parts  [][]reflect.Value
+	fields []string
+	orders []orderBy
+	items  [][2]int
+}
+
+func (h *rowHeap) Len() int      { return len(h.items) }
+func (h *rowHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *rowHeap) Push(x interface{}) {
+	h.items = append(h.items, x.([2]int))
+}
+func (h *rowHeap) Pop() interface{} {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+func (h *rowHeap) Less(i, j int) bool {
+	a := h.parts[h.items[i][0]][h.items[i][1]]
+	b := h.parts[h.items[j][0]][h.items[j][1]]
+	for k, name := range h.fields {
+		c := compareValue(reflect.Indirect(a.FieldByName(name)), reflect.Indirect(b.FieldByName(name)))
+		if c == 0 {
+			continue
+		}
+		if h.orders[k].desc {
+			return c > 0
+		}
+		return c < 0
+	}
+	return h.items[i][0] < h.items[j][0]
+}
+
+func compareValue(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.Int64:
+		return compareOrdered(a.Int() < b.Int(), a.Int() > b.Int())
+	case reflect.Uint64:
+		return compareOrdered(a.Uint() < b.Uint(), a.Uint() > b.Uint())
+	case reflect.Float64:
+		return compareOrdered(a.Float() < b.Float(), a.Float() > b.Float())
+	}
+	return strings.Compare(a.String(), b.String())
+}
+
+func compareOrdered(less, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
+
+const (
+	aggCount = iota
+	aggSum
+	aggMin
+	aggMax
+	aggAvg
+)
+
+var aggFuncs = map[string]int{
+	"COUNT": aggCount,
+	"SUM":   aggSum,
+	"MIN":   aggMin,
+	"MAX":   aggMax,
+	"AVG":   aggAvg,
+}
+
+// run an aggregate query without GROUP BY on every physical shard of md and
+// merge COUNT/SUM/MIN/MAX/AVG, values are returned in order of the select list.
+// AVG(x) is rewritten to SUM(x), COUNT(x) for each shard
+func (o *orm) AggregateAll(md interface{}, query string, args ...interface{}) ([]interface{}, error) {
+	return o.AggregateAllContext(context.Background(), md, query, args...)
+}
+
+func (o *orm) AggregateAllContext(ctx context.Context, md interface{}, query string, args ...interface{}) ([]interface{}, error) {
+	o.reload()
+	fullName := getFullName(md)
+	m, ok := o.topo.models[fullName]
+	if !ok {
+		return nil, fmt.Errorf("<orm.AggregateAll> unknown model name `%s`", fullName)
+	}
+
+	query, aggs, err := rewriteAggregate(query)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := o.shards(m)
+	if err != nil {
+		return nil, err
+	}
+
+	cols := 0
+	for _, agg := range aggs {
+		cols++
+		if agg == aggAvg {
+			cols++
+		}
+	}
+	parts := make([][]interface{}, len(targets))
+	err = o.scatter(ctx, targets, func(i int, q sqlQuerier, t Target) error {
+		row := q.QueryRowContext(ctx, replaceTable(query, m.table, t.Table), args...)
+		vals := make([]interface{}, cols)
+		raws := make([]interface{}, cols)
+		for k := range raws {
+			raws[k] = &vals[k]
+		}
+		if err := row.Scan(raws...); err != nil {
+			return err
+		}
+		parts[i] = vals
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeAggregate(aggs, parts)
+}
+
+// check the select list is made of aggregates and rewrite AVG
+func rewriteAggregate(query string) (string, []int, error) {
+	toks := tokenize(query)
+	sel := findKeyword(toks, 0, "SELECT")
+	from := findKeyword(toks, 0, "FROM")
+	if sel < 0 || from < sel {
+		return "", nil, fmt.Errorf("<orm.AggregateAll> bad select `%s`", query)
+	}
+	if findKeyword(toks, from, "GROUP") >= 0 {
+		return "", nil, fmt.Errorf("<orm.AggregateAll> GROUP BY is not supported across shards")
+	}
+
+	var (
+		aggs  []int
+		items []string
+	)
+	for _, item := range splitTokens(toks[sel+1:from], ",") {
+		f := nextToken(item, -1)
+		agg, ok := -1, false
+		if f >= 0 && item[f].kind == tokIdent {
+			agg, ok = aggFuncs[strings.ToUpper(item[f].text)]
+		}
+		open := nextToken(item, f)
+		if !ok || open < 0 || item[open].text != "(" {
+			return "", nil, fmt.Errorf("<orm.AggregateAll> `%s` is not an aggregate", strings.TrimSpace(joinTokens(item)))
+		}
+		close := matchParen(item, open)
+		if close < 0 {
+			return "", nil, fmt.Errorf("<orm.AggregateAll> bad select `%s`", query)
+		}
+		if rest := nextToken(item, close); rest >= 0 {
+			if item[rest].is("AS") {
+				rest = nextToken(item, rest)
+			}
+			if rest < 0 || (item[rest].kind != tokIdent && item[rest].kind != tokQuoted) || nextToken(item, rest) >= 0 {
+				return "", nil, fmt.Errorf("<orm.AggregateAll> `%s` is not an aggregate", strings.TrimSpace(joinTokens(item)))
+			}
+		}
+		if d := nextToken(item, open); d >= 0 && item[d].is("DISTINCT") {
+			return "", nil, fmt.Errorf("<orm.AggregateAll> DISTINCT is not supported across shards")
+		}
+		arg := joinTokens(item[open+1 : close])
+		aggs = append(aggs, agg)
+		if agg == aggAvg {
+			items = append(items, "SUM("+arg+")", "COUNT("+arg+")")
+		} else {
+			items = append(items, strings.ToUpper(item[f].text)+"("+arg+")")
+		}
+	}
+	rewrite := joinTokens(toks[:sel+1]) + " " + strings.Join(items, ", ") + " " + joinTokens(toks[from:])
+	return rewrite, aggs, nil
+}
+
+// merge the aggregate row of every shard
+func mergeAggregate(aggs []int, parts [][]interface{}) ([]interface{}, error) {
+	res := make([]interface{}, 0, len(aggs))
+	col := 0
+	for _, agg := range aggs {
+		var (
+			value interface{}
+			sum   = &numSum{}
+			count = &numSum{}
+		)
+		for _, vals := range parts {
+			v := vals[col]
+			switch agg {
+			case aggCount:
+				count.add(v)
+			case aggSum:
+				sum.add(v)
+			case aggMin, aggMax:
+				if v == nil {
+					continue
+				}
+				s := ToStr(v)
+				if value == nil {
+					value = s
+				} else if c := compareText(s, value.(string)); (agg == aggMin && c < 0) || (agg == aggMax && c > 0) {
+					value = s
+				}
+			case aggAvg:
+				sum.add(v)
+				count.add(vals[col+1])
+			}
+		}
+		if sum.err != nil {
+			return nil, sum.err
+		}
+		if count.err != nil {
+			return nil, count.err
+		}
+
+		switch agg {
+		case aggCount:
+			value = count.i
+		case aggSum:
+			value = sum.value()
+		case aggMin, aggMax:
+			if value != nil {
+				value = numberValue(value.(string))
+			}
+		case aggAvg:
+			if count.i > 0 {
+				value = sum.float() / float64(count.i)
+			}
+			col++
+		}
+		res = append(res, value)
+		col++
+	}
+	return res, nil
+}
+
+// sum of numbers from db, kept integer until a float is added
+type numSum struct {
+	i       int64
+	f       float64
+	isFloat bool
+	count   int
+	err     error
+}
+
+func (s *numSum) add(v interface{}) {
+	if v == nil || s.err != nil {
+		return
+	}
+	s.count++
+	str := ToStr(v)
+	if n, err := strconv.ParseInt(str, 10, 64); err == nil && !s.isFloat {
+		s.i += n
+		return
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		s.err = fmt.Errorf("<orm.AggregateAll> `%s` is not number", str)
+		return
+	}
+	if !s.isFloat {
+		s.isFloat = true
+		s.f = float64(s.i)
+	}
+	s.f += f
+}
+
+func (s *numSum) float() float64 {
+	if s.isFloat {
+		return s.f
+	}
+	return float64(s.i)
+}
+
+func (s *numSum) value() interface{} {
+	if s.count == 0 {
+		return nil
+	}
+	if s.isFloat {
+		return s.f
+	}
+	return s.i
+}
+
+// compare as number when both are numeric
+func compareText(a, b string) int {
+	fa, ea := strconv.ParseFloat(a, 64)
+	fb, eb := strconv.ParseFloat(b, 64)
+	if ea == nil && eb == nil {
+		return compareOrdered(fa < fb, fa > fb)
+	}
+	return strings.Compare(a, b)
+}
+
+func numberValue(s string) interface{} {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
+
+// index of keyword at paren depth 0 from start, -1 if none
+func findKeyword(toks []token, start int, keyword string) int {
+	depth := 0
+	for i := start; i < len(toks); i++ {
+		switch {
+		case toks[i].text == "(":
+			depth++
+		case toks[i].text == ")":
+			depth--
+		case depth == 0 && toks[i].is(keyword):
+			return i
+		}
+	}
+	return -1
+}
+
+// index of the paren closing the one at open, -1 if none
+func matchParen(toks []token, open int) int {
+	depth := 0
+	for i := open; i < len(toks); i++ {
+		switch toks[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// split tokens by sep at paren depth 0
+func splitTokens(toks []token, sep string) [][]token {
+	var (
+		parts [][]token
+		depth int
+		start int
+	)
+	for i, t := range toks {
+		switch {
+		case t.text == "(":
+			depth++
+		case t.text == ")":
+			depth--
+		case depth == 0 && t.text == sep:
+			parts = append(parts, toks[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, toks[start:])
+}
+
+// index of the argument of placeholder at i
+func argIndex(toks []token, i int) int {
+	n := 0
+	for k := 0; k < i; k++ {
+		if toks[k].kind == tokArg {
+			n++
+		}
+	}
+	return n
+}
+
+func hasInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package sharding
+
+import (
+	"reflect"
+	"testing"
+)
+
+type mergeRow struct {
+	Id   int64
+	Name string
+}
+
+var mergeModel = &modelInfo{
+	c2n: map[string]string{"id": "Id", "name": "Name"},
+	n2c: map[string]string{"Id": "id", "Name": "name"},
+}
+
+func TestParsePagination(t *testing.T) {
+	cases := []struct {
+		query    string
+		args     []interface{}
+		rewrite  string
+		rest     []interface{}
+		orders   []orderBy
+		hasLimit bool
+		offset   int64
+		limit    int64
+	}{
+		{"SELECT * FROM t", nil, "SELECT * FROM t", nil, nil, false, 0, 0},
+		{"SELECT * FROM t ORDER BY `id` DESC, name", nil, "SELECT * FROM t ORDER BY `id` DESC, name", nil,
+			[]orderBy{{"id", true}, {"name", false}}, false, 0, 0},
+		{"SELECT * FROM t LIMIT 10", nil, "SELECT * FROM t LIMIT 10", nil, nil, true, 0, 10},
+		{"SELECT * FROM t LIMIT 20, 10", nil, "SELECT * FROM t LIMIT 30", nil, nil, true, 20, 10},
+		{"SELECT * FROM t LIMIT 10 OFFSET 20", nil, "SELECT * FROM t LIMIT 30", nil, nil, true, 20, 10},
+		{"SELECT * FROM t WHERE a = ? ORDER BY id LIMIT ?, ? FOR UPDATE", []interface{}{1, 5, 10},
+			"SELECT * FROM t WHERE a = ? ORDER BY id LIMIT 15 FOR UPDATE", []interface{}{1},
+			[]orderBy{{"id", false}}, true, 5, 10},
+	}
+	for _, c := range cases {
+		rewrite, rest, p, err := parsePagination(c.query, c.args)
+		if err != nil {
+			t.Errorf("%s: %v", c.query, err)
+			continue
+		}
+		if rewrite != c.rewrite || len(rest) != len(c.rest) || (len(rest) > 0 && !reflect.DeepEqual(rest, c.rest)) {
+			t.Errorf("%s: got %q %v, want %q %v", c.query, rewrite, rest, c.rewrite, c.rest)
+		}
+		if !reflect.DeepEqual(p.orders, c.orders) || p.hasLimit != c.hasLimit || p.offset != c.offset || p.limit != c.limit {
+			t.Errorf("%s: got %+v", c.query, p)
+		}
+	}
+
+	for _, query := range []string{
+		"SELECT * FROM t ORDER id",
+		"SELECT * FROM t ORDER BY LOWER(name)",
+		"SELECT * FROM t LIMIT x",
+	} {
+		if _, _, _, err := parsePagination(query, nil); err == nil {
+			t.Errorf("%s: want error", query)
+		}
+	}
+}
+
+func TestMergeRows(t *testing.T) {
+	part := func(rows ...mergeRow) []reflect.Value {
+		vals := make([]reflect.Value, len(rows))
+		for i := range rows {
+			vals[i] = reflect.ValueOf(rows[i])
+		}
+		return vals
+	}
+	parts := [][]reflect.Value{
+		part(mergeRow{1, "a"}, mergeRow{4, "d"}),
+		part(),
+		part(mergeRow{2, "b"}, mergeRow{3, "c"}, mergeRow{5, "e"}),
+	}
+	// every shard returns its rows already sorted
+	desc := [][]reflect.Value{
+		part(mergeRow{4, "d"}, mergeRow{1, "a"}),
+		part(mergeRow{5, "e"}, mergeRow{3, "c"}, mergeRow{2, "b"}),
+	}
+	cases := []struct {
+		parts [][]reflect.Value
+		p     *pagination
+		ids   []int64
+	}{
+		{parts, &pagination{}, []int64{1, 4, 2, 3, 5}},
+		{parts, &pagination{orders: []orderBy{{"id", false}}}, []int64{1, 2, 3, 4, 5}},
+		{desc, &pagination{orders: []orderBy{{"Name", true}}}, []int64{5, 4, 3, 2, 1}},
+		{parts, &pagination{orders: []orderBy{{"id", false}}, hasLimit: true, offset: 1, limit: 2}, []int64{2, 3}},
+		{parts, &pagination{orders: []orderBy{{"id", false}}, hasLimit: true, offset: 4, limit: 10}, []int64{5}},
+		{parts, &pagination{orders: []orderBy{{"id", false}}, hasLimit: true, offset: 5, limit: 10}, nil},
+	}
+	for i, c := range cases {
+		rows, err := mergeRows(c.parts, mergeModel, c.p)
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		var ids []int64
+		for _, row := range rows {
+			ids = append(ids, row.Interface().(mergeRow).Id)
+		}
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("case %d: got %v, want %v", i, ids, c.ids)
+		}
+	}
+
+	if _, err := mergeRows(parts, mergeModel, &pagination{orders: []orderBy{{"age", false}}}); err == nil {
+		t.Error("unknown ORDER BY column: want error")
+	}
+}
+
+func TestRewriteAggregate(t *testing.T) {
+	cases := []struct {
+		query   string
+		rewrite string
+		aggs    []int
+	}{
+		{"SELECT COUNT(*) FROM t", "SELECT COUNT(*) FROM t", []int{aggCount}},
+		{"SELECT sum(a), AVG(b) AS avg_b FROM t WHERE c = ?", "SELECT SUM(a), SUM(b), COUNT(b) FROM t WHERE c = ?", []int{aggSum, aggAvg}},
+		{"SELECT MIN(a), MAX(a) FROM t", "SELECT MIN(a), MAX(a) FROM t", []int{aggMin, aggMax}},
+	}
+	for _, c := range cases {
+		rewrite, aggs, err := rewriteAggregate(c.query)
+		if err != nil {
+			t.Errorf("%s: %v", c.query, err)
+			continue
+		}
+		if rewrite != c.rewrite || !reflect.DeepEqual(aggs, c.aggs) {
+			t.Errorf("%s: got %q %v, want %q %v", c.query, rewrite, aggs, c.rewrite, c.aggs)
+		}
+	}
+
+	for _, query := range []string{
+		"SELECT a FROM t",
+		"SELECT COUNT(DISTINCT a) FROM t",
+		"SELECT COUNT(*) FROM t GROUP BY a",
+		"UPDATE t SET a = 1",
+	} {
+		if _, _, err := rewriteAggregate(query); err == nil {
+			t.Errorf("%s: want error", query)
+		}
+	}
+}
+
+func TestMergeAggregate(t *testing.T) {
+	cases := []struct {
+		aggs  []int
+		parts [][]interface{}
+		want  []interface{}
+	}{
+		{[]int{aggCount}, [][]interface{}{{int64(2)}, {int64(3)}}, []interface{}{int64(5)}},
+		{[]int{aggSum}, [][]interface{}{{[]byte("2")}, {nil}, {[]byte("3")}}, []interface{}{int64(5)}},
+		{[]int{aggSum}, [][]interface{}{{[]byte("1.5")}, {[]byte("2")}}, []interface{}{3.5}},
+		{[]int{aggSum}, [][]interface{}{{nil}, {nil}}, []interface{}{nil}},
+		{[]int{aggMin, aggMax}, [][]interface{}{{[]byte("10"), []byte("10")}, {[]byte("9"), []byte("9")}, {nil, nil}},
+			[]interface{}{int64(9), int64(10)}},
+		{[]int{aggMax}, [][]interface{}{{[]byte("b")}, {[]byte("a")}}, []interface{}{"b"}},
+		{[]int{aggAvg, aggCount}, [][]interface{}{{[]byte("6"), int64(2), int64(2)}, {[]byte("3"), int64(1), int64(1)}},
+			[]interface{}{3.0, int64(3)}},
+		{[]int{aggAvg}, [][]interface{}{{nil, int64(0)}}, []interface{}{nil}},
+	}
+	for i, c := range cases {
+		got, err := mergeAggregate(c.aggs, c.parts)
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %d: got %#v, want %#v", i, got, c.want)
+		}
+	}
+
+	if _, err := mergeAggregate([]int{aggSum}, [][]interface{}{{[]byte("x")}}); err == nil {
+		t.Error("SUM of text: want error")
+	}
+}
@@ -0,0 +1,505 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"strings"
+)
+
+// default rows of a batch copied by Migration
+const MigrateBatchSize = 500
+
+// strategy with writes dual written to a migration target
+type shadowStrategy interface {
+	shadow(table string, value interface{}) (Target, bool)
+	shadowFailed(table string, value interface{}, err error)
+	isMigrating(values []interface{}) bool
+}
+
+// dual write waiting for the commit of a transaction on another alias
+type shadowOp struct {
+	strategy shadowStrategy
+	table    string
+	value    interface{}
+	alias    string
+	query    string
+	args     []interface{}
+}
+
+// repeat a succeed write on the migration target of model instance, in the
+// transaction of orm when it covers the target, otherwise after its commit.
+// a failure is recorded so that the migration can't be verified
+func (o *orm) shadowWrite(ctx context.Context, md interface{}, model *modelInfo, table string, query string, args ...interface{}) {
+	s, ok := o.topo.strategy(model).(shadowStrategy)
+	if !ok {
+		return
+	}
+	value := shardValue(md, model)
+	t, ok := s.shadow(model.table, value)
+	if !ok {
+		return
+	}
+	op := shadowOp{strategy: s, table: model.table, value: value, alias: t.Alias, query: replaceTable(query, table, t.Table), args: args}
+	if o.isTx && t.Alias != o.aliasName {
+		o.shadows = append(o.shadows, op)
+		return
+	}
+	q, err := o.querier(ctx, t.Alias)
+	if err == nil {
+		_, err = q.ExecContext(ctx, op.query, op.args...)
+	}
+	if err != nil {
+		s.shadowFailed(op.table, op.value, err)
+	}
+}
+
+// run the dual writes waiting for the commit of transaction
+func (o *orm) flushShadows() {
+	ops := o.shadows
+	o.shadows = nil
+	for _, op := range ops {
+		db, ok := o.topo.dbs[op.alias]
+		if !ok {
+			op.strategy.shadowFailed(op.table, op.value, fmt.Errorf("<orm> unknown db alias name `%s`", op.alias))
+			continue
+		}
+		if _, err := db.Exec(op.query, op.args...); err != nil {
+			op.strategy.shadowFailed(op.table, op.value, err)
+		}
+	}
+}
+
+// dual write an inserted row with REPLACE, or with the ON DUPLICATE KEY
+// UPDATE tail of an upsert. a pk given by db auto increment is written as id
+// so target keeps the id of source, the write fails when id is unknown
+func (o *orm) shadowInsert(ctx context.Context, md interface{}, model *modelInfo, table string, cols []string, vals []interface{}, id int64, tail string) {
+	if len(model.pk) > 0 && len(model.auto) == 0 {
+		k := -1
+		for i, column := range cols {
+			if column == model.pk {
+				k = i
+			}
+		}
+		switch {
+		case id > 0 && k < 0:
+			cols = append(cols[:len(cols):len(cols)], model.pk)
+			vals = append(vals[:len(vals):len(vals)], id)
+		case id > 0:
+			vals = append([]interface{}{}, vals...)
+			vals[k] = id
+		case k < 0 || vals[k] == nil || reflect.ValueOf(vals[k]).IsZero():
+			o.shadowFail(md, model, fmt.Errorf("<orm> id of row inserted into `%s` unknown", table))
+			return
+		}
+	}
+
+	verb := "REPLACE"
+	if len(tail) > 0 {
+		verb = "INSERT"
+	}
+	sep := fmt.Sprintf("%s, %s", TableQuote, TableQuote)
+	marks := strings.TrimRight(strings.Repeat(PrepareDelim+ColumnDelim+" ", len(cols)), ColumnDelim+" ")
+	query := fmt.Sprintf("%s INTO %s%s%s (%s%s%s) VALUES (%s)%s", verb, TableQuote, table, TableQuote, TableQuote, strings.Join(cols, sep), TableQuote, marks, tail)
+	o.shadowWrite(ctx, md, model, table, query, vals...)
+}
+
+// record a failed dual write of md when its bucket is migrating
+func (o *orm) shadowFail(md interface{}, model *modelInfo, err error) {
+	s, ok := o.topo.strategy(model).(shadowStrategy)
+	if !ok {
+		return
+	}
+	value := shardValue(md, model)
+	if _, ok := s.shadow(model.table, value); ok {
+		s.shadowFailed(model.table, value, err)
+	}
+}
+
+// online migration of a bucket of model to a new alias and table suffix:
+//   m, err := NewMigration(&Order{}, strategy, 7, "db_3", "07")
+//   m.Start()  // writes of the bucket are dual written to the target
+//   m.Copy()   // copy existing rows in batches ordered by key
+//   m.Verify() // compare row count and checksum of the bucket on both sides
+//   m.Flip()   // route the bucket to the target and stop dual write
+//   m.Cleanup("db_1", "03") // delete the rows of the bucket from the old shard
+// models bound to model by BindStrategy follow its routing, their rows of
+// the bucket are copied, verified and cleaned up with it. rows updated while
+// being copied may be stale on target, Verify reports them and Copy can be
+// run again
+type Migration struct {
+	BatchSize int
+	model     *modelInfo
+	strategy  *BucketStrategy
+	bucket    int
+	to        bucketAssign
+	tables    []*migrateTable
+}
+
+// a model moved by Migration, bucket maps its shard key value to the bucket
+type migrateTable struct {
+	model  *modelInfo
+	key    string
+	bucket func(value interface{}) (int, error)
+}
+
+func NewMigration(md interface{}, strategy *BucketStrategy, bucket int, alias, suffix string) (*Migration, error) {
+	fullName := getFullName(md)
+	t := strategy.registry().load()
+	model, ok := t.models[fullName]
+	if !ok {
+		return nil, fmt.Errorf("<sharding.NewMigration> unknown model name `%s`", fullName)
+	}
+	if b, ok := t.strategy(model).(*BindStrategy); ok {
+		return nil, fmt.Errorf("<sharding.NewMigration> model `%s` is bound to `%s`, migrate the parent", fullName, b.parent)
+	}
+	if t.strategy(model) != ShardStrategy(strategy) {
+		return nil, fmt.Errorf("<sharding.NewMigration> model `%s` is not routed by the strategy", fullName)
+	}
+	if bucket < 0 || bucket >= strategy.buckets {
+		return nil, fmt.Errorf("<sharding.NewMigration> bucket `%d` out of range [0, %d)", bucket, strategy.buckets)
+	}
+	m := &Migration{
+		BatchSize: MigrateBatchSize,
+		model:     model,
+		strategy:  strategy,
+		bucket:    bucket,
+		to:        bucketAssign{alias: alias, suffix: suffix},
+	}
+	m.addTable(t, model, func(value interface{}) (int, error) {
+		return strategy.Bucket(value), nil
+	})
+	return m, nil
+}
+
+// add model and the models bound to it
+func (m *Migration) addTable(t *topology, model *modelInfo, bucket func(value interface{}) (int, error)) {
+	key := model.pk
+	if len(key) == 0 {
+		key = model.uk
+	}
+	m.tables = append(m.tables, &migrateTable{model: model, key: key, bucket: bucket})
+	for _, child := range t.sortedModels() {
+		b, ok := t.strategy(child).(*BindStrategy)
+		if !ok || b.parent != model.fullName {
+			continue
+		}
+		lookup := b.lookup
+		m.addTable(t, child, func(value interface{}) (int, error) {
+			if lookup != nil {
+				var err error
+				if value, err = lookup(value); err != nil {
+					return 0, err
+				}
+			}
+			return bucket(value)
+		})
+	}
+}
+
+// start dual write of the bucket, the state is kept in the config table so
+// every instance dual writes after its next Load
+func (m *Migration) Start() error {
+	from, err := m.source(m.tables[0])
+	if err != nil {
+		return err
+	}
+	if from == m.target(m.tables[0]) {
+		return fmt.Errorf("<Migration.Start> bucket `%d` already on `%s.%s`", m.bucket, from.Alias, from.Table)
+	}
+	return m.strategy.startMigrate(m.bucket, m.to)
+}
+
+// copy rows of the bucket from source to target, rows already on target
+// are overwritten and rows gone from source are deleted, so a stale copy is
+// fixed by running it again
+func (m *Migration) Copy() error {
+	for _, mt := range m.tables {
+		if err := m.copy(mt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migration) copy(mt *migrateTable) error {
+	from, err := m.source(mt)
+	if err != nil {
+		return err
+	}
+	to := m.target(mt)
+	db, err := m.db(to.Alias)
+	if err != nil {
+		return err
+	}
+
+	err = m.scan(mt, from, func(batch [][]interface{}) error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var (
+			marks []string
+			args  []interface{}
+		)
+		row := "(" + strings.TrimRight(strings.Repeat(PrepareDelim+ColumnDelim, len(mt.model.fields)), ColumnDelim) + ")"
+		for _, vals := range batch {
+			marks = append(marks, row)
+			args = append(args, vals...)
+		}
+		query := fmt.Sprintf("REPLACE INTO %s%s%s (%s) VALUES %s", TableQuote, to.Table, TableQuote, mt.model.columns, strings.Join(marks, ColumnDelim))
+		_, err := db.Exec(query, args...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return m.prune(mt, from, to)
+}
+
+// delete rows of the bucket on target whose key is not on source, left by a
+// row deleted after it was copied or a rolled back dual write
+func (m *Migration) prune(mt *migrateTable, from, to Target) error {
+	src, err := m.db(from.Alias)
+	if err != nil {
+		return err
+	}
+	dst, err := m.db(to.Alias)
+	if err != nil {
+		return err
+	}
+	keyIndex := mt.model.fields[mt.key].fieldIndex
+	return m.scan(mt, to, func(batch [][]interface{}) error {
+		if len(batch) == 0 {
+			return nil
+		}
+		keys := make([]interface{}, 0, len(batch))
+		for _, vals := range batch {
+			keys = append(keys, vals[keyIndex])
+		}
+		marks := strings.TrimRight(strings.Repeat(PrepareDelim+ColumnDelim, len(keys)), ColumnDelim)
+		query := fmt.Sprintf("SELECT %s%s%s FROM %s%s%s WHERE %s%s%s IN (%s)", TableQuote, mt.key, TableQuote, TableQuote, from.Table, TableQuote, TableQuote, mt.key, TableQuote, marks)
+		rows, err := src.Query(query, keys...)
+		if err != nil {
+			return err
+		}
+		found := make(map[string]bool, len(keys))
+		for rows.Next() {
+			var key interface{}
+			if err = rows.Scan(&key); err != nil {
+				rows.Close()
+				return err
+			}
+			found[ToStr(key)] = true
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		var gone []interface{}
+		for _, key := range keys {
+			if !found[ToStr(key)] {
+				gone = append(gone, key)
+			}
+		}
+		if len(gone) == 0 {
+			return nil
+		}
+		marks = strings.TrimRight(strings.Repeat(PrepareDelim+ColumnDelim, len(gone)), ColumnDelim)
+		query = fmt.Sprintf("DELETE FROM %s%s%s WHERE %s%s%s IN (%s)", TableQuote, to.Table, TableQuote, TableQuote, mt.key, TableQuote, marks)
+		_, err = dst.Exec(query, gone...)
+		return err
+	})
+}
+
+// compare row count and checksum of the bucket on source and target
+func (m *Migration) Verify() error {
+	// pick up dual write failures of other instances
+	if err := m.strategy.Load(); err != nil {
+		return err
+	}
+	if err := m.strategy.migrateErr(m.bucket); err != nil {
+		return fmt.Errorf("<Migration.Verify> dual write failed, %s", err.Error())
+	}
+	for _, mt := range m.tables {
+		from, err := m.source(mt)
+		if err != nil {
+			return err
+		}
+		srcCount, srcSum, err := m.checksum(mt, from)
+		if err != nil {
+			return err
+		}
+		dstCount, dstSum, err := m.checksum(mt, m.target(mt))
+		if err != nil {
+			return err
+		}
+		if srcCount != dstCount || srcSum != dstSum {
+			return fmt.Errorf("<Migration.Verify> bucket `%d` of `%s` mismatch, source %d rows checksum %08x, target %d rows checksum %08x",
+				m.bucket, mt.model.table, srcCount, srcSum, dstCount, dstSum)
+		}
+	}
+	return nil
+}
+
+// route the bucket to target, dual write stops
+func (m *Migration) Flip() error {
+	return m.strategy.Assign(m.bucket, m.to.alias, m.to.suffix)
+}
+
+// stop dual write without flipping
+func (m *Migration) Abort() error {
+	return m.strategy.stopMigrate(m.bucket)
+}
+
+// delete rows of the bucket left on the source after Flip
+func (m *Migration) Cleanup(alias, suffix string) error {
+	old := bucketAssign{alias: alias, suffix: suffix}
+	if cur, err := m.strategy.assign(m.bucket); err != nil {
+		return err
+	} else if cur == old {
+		return fmt.Errorf("<Migration.Cleanup> bucket `%d` is still routed to `%s.%s`", m.bucket, alias, old.table(m.model.table))
+	}
+	db, err := m.db(alias)
+	if err != nil {
+		return err
+	}
+
+	for _, mt := range m.tables {
+		from := Target{Alias: alias, Table: old.table(mt.model.table)}
+		keyIndex := mt.model.fields[mt.key].fieldIndex
+		err = m.scan(mt, from, func(batch [][]interface{}) error {
+			if len(batch) == 0 {
+				return nil
+			}
+			keys := make([]interface{}, 0, len(batch))
+			for _, vals := range batch {
+				keys = append(keys, vals[keyIndex])
+			}
+			marks := strings.TrimRight(strings.Repeat(PrepareDelim+ColumnDelim, len(keys)), ColumnDelim)
+			query := fmt.Sprintf("DELETE FROM %s%s%s WHERE %s%s%s IN (%s)", TableQuote, from.Table, TableQuote, TableQuote, mt.key, TableQuote, marks)
+			_, err := db.Exec(query, keys...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// current physical shard of the bucket for mt
+func (m *Migration) source(mt *migrateTable) (Target, error) {
+	a, err := m.strategy.assign(m.bucket)
+	if err != nil {
+		return Target{}, err
+	}
+	return Target{Alias: a.alias, Table: a.table(mt.model.table)}, nil
+}
+
+func (m *Migration) target(mt *migrateTable) Target {
+	return Target{Alias: m.to.alias, Table: m.to.table(mt.model.table)}
+}
+
+// count and xor of row crc32 of the bucket on t
+func (m *Migration) checksum(mt *migrateTable, t Target) (int64, uint32, error) {
+	var (
+		count int64
+		sum   uint32
+	)
+	err := m.scan(mt, t, func(batch [][]interface{}) error {
+		for _, vals := range batch {
+			strs := make([]string, len(vals))
+			for i, v := range vals {
+				if v == nil {
+					strs[i] = "\x00"
+				} else {
+					strs[i] = ToStr(v)
+				}
+			}
+			count++
+			sum ^= crc32.ChecksumIEEE([]byte(strings.Join(strs, "\x1f")))
+		}
+		return nil
+	})
+	return count, sum, err
+}
+
+// read all rows of t in batches ordered by key, fn gets rows of the bucket
+func (m *Migration) scan(mt *migrateTable, t Target, fn func(batch [][]interface{}) error) error {
+	db, err := m.db(t.Alias)
+	if err != nil {
+		return err
+	}
+	size := m.BatchSize
+	if size <= 0 {
+		size = MigrateBatchSize
+	}
+
+	var last interface{}
+	for {
+		query := fmt.Sprintf("SELECT %s FROM %s%s%s", mt.model.columns, TableQuote, t.Table, TableQuote)
+		var args []interface{}
+		if last != nil {
+			query += fmt.Sprintf(" WHERE %s%s%s > ?", TableQuote, mt.key, TableQuote)
+			args = append(args, last)
+		}
+		query += fmt.Sprintf(" ORDER BY %s%s%s LIMIT %d", TableQuote, mt.key, TableQuote, size)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		batch, n, err := m.readBatch(mt, rows, &last)
+		if err != nil {
+			return err
+		}
+		if err = fn(batch); err != nil {
+			return err
+		}
+		if n < size {
+			return nil
+		}
+	}
+}
+
+// read rows of the bucket, last is set to the key of the last row read
+func (m *Migration) readBatch(mt *migrateTable, rows *sql.Rows, last *interface{}) ([][]interface{}, int, error) {
+	defer rows.Close()
+	var (
+		batch [][]interface{}
+		n     int
+	)
+	key := mt.model.fields[mt.key]
+	shard := mt.model.fields[mt.model.shard]
+	for rows.Next() {
+		vals := make([]interface{}, len(mt.model.fields))
+		refs := make([]interface{}, len(vals))
+		for i := range vals {
+			refs[i] = &vals[i]
+		}
+		if err := rows.Scan(refs...); err != nil {
+			return nil, 0, err
+		}
+		n++
+		*last = convertValueFromDB(key, vals[key.fieldIndex])
+		bucket, err := mt.bucket(convertValueFromDB(shard, vals[shard.fieldIndex]))
+		if err != nil {
+			return nil, 0, err
+		}
+		if bucket == m.bucket {
+			batch = append(batch, vals)
+		}
+	}
+	return batch, n, rows.Err()
+}
+
+func (m *Migration) db(alias string) (*sql.DB, error) {
+	db, ok := m.strategy.registry().load().dbs[alias]
+	if !ok {
+		return nil, fmt.Errorf("<Migration> unknown db alias name `%s`", alias)
+	}
+	return db, nil
+}
@@ -1,12 +1,14 @@
 package sharding
 
 import (
+	"context"
 	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
 	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 )
 
 var (
@@ -20,6 +22,7 @@ var (
     ErrUnkownModel   = errors.New("no model found")
     ErrNoModel       = errors.New("<Query2Obj> must model slice ptr")
     ErrUnkownColumn  = errors.New("<Query2Obj> no mathch column found, do you use alias name")
+	ErrNoAlias       = errors.New("<orm> no db alias, call Using first")
 )
 
 type orm struct {
@@ -27,14 +30,22 @@ type orm struct {
 	tx 	*sql.Tx
 	aliasName string
 	isTx  bool
+	xa	*xaTx
+	reg	*Registry
+	topo	*topology
+	primary	bool
+	window	time.Duration
+	writes	map[string]time.Time
+	shadows	[]shadowOp
 }
 
 func (o *orm) Using(aliasName string) error {
-	if o.isTx {
+	if o.isTx || o.xa != nil {
 		panic(fmt.Errorf("<orm.Using> transaction has been start, cannot change db"))
 	}
 
-	if db, ok := dbConn[aliasName]; ok {
+	o.topo = o.reg.load()
+	if db, ok := o.topo.dbs[aliasName]; ok {
 		o.db = db
 		o.aliasName = aliasName
 	} else {
@@ -44,7 +55,24 @@ func (o *orm) Using(aliasName string) error {
 	return nil
 }
 
+// take the current snapshot of registry outside transaction, so a long-lived
+// orm follows ApplyConfig instead of using the dbs it replaced
+func (o *orm) reload() {
+	if o.isTx || o.xa != nil {
+		return
+	}
+	o.topo = o.reg.load()
+	if len(o.aliasName) > 0 {
+		o.db = o.topo.dbs[o.aliasName]
+	}
+}
+
 func (o *orm) Read(md interface{}, cols ...string) error {
+	return o.ReadContext(context.Background(), md, cols...)
+}
+
+func (o *orm) ReadContext(ctx context.Context, md interface{}, cols ...string) error {
+	o.reload()
 	var (
 		whereCols []string
 		argsCols []interface{}
@@ -53,11 +81,17 @@ func (o *orm) Read(md interface{}, cols ...string) error {
 	)
 
 	fullName := getFullName(md)
-	if _, ok := models[fullName]; !ok {
+	if _, ok := o.topo.models[fullName]; !ok {
 		return fmt.Errorf("<orm.Read> unknown model name `%s`", fullName)
 	}
 
-	model = models[fullName]
+	model = o.topo.models[fullName]
+
+	if len(cols) == 1 {
+		if err := o.routeByLookup(ctx, md, model, cols[0]); err != nil {
+			return err
+		}
+	}
 
 	val := reflect.ValueOf(md)
 	ind := reflect.Indirect(val)
@@ -90,7 +124,10 @@ func (o *orm) Read(md interface{}, cols ...string) error {
 	}
 	wheres := strings.Join(whereCols, Sep)
 
-	table := getTableName(md)
+	q, table, err := o.route(ctx, md, model, true)
+	if err != nil {
+		return err
+	}
 
 	query := fmt.Sprintf("SELECT %s FROM %s%s%s WHERE %s%s%s = ?", model.columns, TableQuote, table, TableQuote, TableQuote, wheres, TableQuote)
 
@@ -99,12 +136,10 @@ func (o *orm) Read(md interface{}, cols ...string) error {
 		var ref interface{}
 		refs[i] = &ref
 	}
-	if !o.isTx {
-		row = o.db.QueryRow(query, argsCols...)
-	} else {
+	if o.isTx || o.xa != nil {
 		query += ForUp
-		row = o.tx.QueryRow(query, argsCols...)
 	}
+	row = q.QueryRowContext(ctx, query, argsCols...)
 	
 	if err := row.Scan(refs...); err != nil {
 		if err == sql.ErrNoRows {
@@ -127,7 +162,56 @@ func (o *orm) Read(md interface{}, cols ...string) error {
 	return nil
 }
 
+// read the rows whose column is in keys into res, a pointer to slice of
+// model. column defaults to the shard column, then the unique or primary
+// key. keys of the shard column are split by shard, so every shard only
+// reads its own keys
+func (o *orm) ReadMulti(res interface{}, keys interface{}, col ...string) error {
+	return o.ReadMultiContext(context.Background(), res, keys, col...)
+}
+
+func (o *orm) ReadMultiContext(ctx context.Context, res interface{}, keys interface{}, col ...string) error {
+	o.reload()
+	m, _, err := o.topo.sliceModel(res)
+	if err != nil {
+		return err
+	}
+	column := m.shard
+	if len(col) > 0 {
+		column = col[0]
+		if _, ok := m.c2n[column]; !ok {
+			if column, ok = m.n2c[col[0]]; !ok {
+				return fmt.Errorf("<orm.ReadMulti> unknown column name `%s`", col[0])
+			}
+		}
+	} else if len(column) == 0 {
+		if column = m.uk; len(column) == 0 {
+			column = m.pk
+		}
+	}
+
+	val := reflect.Indirect(reflect.ValueOf(keys))
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return fmt.Errorf("<orm.ReadMulti> keys must be slice")
+	}
+	if val.Len() == 0 {
+		return nil
+	}
+	args := make([]interface{}, val.Len())
+	for i := range args {
+		args[i] = val.Index(i).Interface()
+	}
+	marks := strings.TrimRight(strings.Repeat("?"+ColumnDelim, len(args)), ColumnDelim)
+	query := fmt.Sprintf("SELECT %s FROM %s%s%s WHERE %s%s%s IN (%s)", m.columns, TableQuote, m.table, TableQuote, TableQuote, column, TableQuote, marks)
+	return o.Query2ObjContext(ctx, res, query, args...)
+}
+
 func (o *orm) Insert(md interface{}) (int64, error){
+	return o.InsertContext(context.Background(), md)
+}
+
+func (o *orm) InsertContext(ctx context.Context, md interface{}) (int64, error){
+	o.reload()
 	var (
 		err error
 		insertCols []string
@@ -136,19 +220,24 @@ func (o *orm) Insert(md interface{}) (int64, error){
 		res sql.Result
 	)
 	fullName := getFullName(md)
-	if _, ok := models[fullName]; !ok {
+	if _, ok := o.topo.models[fullName]; !ok {
 		panic(fmt.Errorf("<orm.Read> unknown model name `%s`", fullName))
 	}
 
-	model := models[fullName]
+	model := o.topo.models[fullName]
 
 	val := reflect.ValueOf(md)
 	ind := reflect.Indirect(val)
 
+	id, err := o.generateId(md, model)
+	if err != nil {
+		return 0, err
+	}
+
 	insertCols = make([]string, 0, len(model.c2n))
 	argsCols = make([]interface{}, 0, len(model.c2n))
 	for k,v := range model.c2n {
-		if k == model.pk {
+		if k == model.pk && len(model.auto) == 0 {
 			continue
 		}
 
@@ -157,24 +246,39 @@ func (o *orm) Insert(md interface{}) (int64, error){
 		qmarks += PrepareDelim + ColumnDelim
 	}
 
-	table := getTableName(md)
+	q, table, err := o.route(ctx, md, model, false)
+	if err != nil {
+		return 0, err
+	}
 	sep := fmt.Sprintf("%s, %s", TableQuote, TableQuote)
 	columns := strings.Join(insertCols, sep)
 	qmarks = strings.TrimRight(qmarks, ColumnDelim)
 	query := fmt.Sprintf("INSERT INTO  %s%s%s (%s%s%s) VALUES (%s) ", TableQuote, table, TableQuote, TableQuote, columns, TableQuote, qmarks)
 
-	if !o.isTx {
-		res, err = o.db.Exec(query, argsCols...)
-	} else {
-		res, err = o.tx.Exec(query, argsCols...)
+	// lookup entries go first, a row without its entry can't be found while
+	// an entry left by a failed insert only holds the value for its shard key
+	if err = o.insertLookups(ctx, md, model); err != nil {
+		return 0, err
 	}
-	if err == nil {
-		return res.LastInsertId()
+	res, err = o.execWrite(ctx, model, q, query, argsCols...)
+	if err != nil {
+		return 0, err
 	}
-	return 0, err
+	if len(model.auto) == 0 {
+		if id, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+	}
+	o.shadowInsert(ctx, md, model, table, insertCols, argsCols, id, "")
+	return id, nil
 }
 
 func (o *orm) Update(md interface{}, cols ...string) (int64, error){
+	return o.UpdateContext(context.Background(), md, cols...)
+}
+
+func (o *orm) UpdateContext(ctx context.Context, md interface{}, cols ...string) (int64, error){
+	o.reload()
 	var (
 		values []interface{}
 		setNames []string
@@ -184,12 +288,12 @@ func (o *orm) Update(md interface{}, cols ...string) (int64, error){
 		res sql.Result
 	)
 	fullName := getFullName(md)
-	if _, ok := models[fullName]; !ok {
+	if _, ok := o.topo.models[fullName]; !ok {
 		err = fmt.Errorf("<orm.Update> unknown model name `%s`", fullName)
 		return 0,err
 	}
 
-	model := models[fullName]
+	model := o.topo.models[fullName]
 	val := reflect.ValueOf(md)
 	ind := reflect.Indirect(val)
 
@@ -224,20 +328,31 @@ func (o *orm) Update(md interface{}, cols ...string) (int64, error){
 				err = fmt.Errorf("<orm.Update> can't update unique key `%s`", column)
 				return 0,err
 			}
+			if column == model.shard && o.topo.strategy(model) != nil {
+				err = fmt.Errorf("<orm.Update> can't update shard key `%s`", column)
+				return 0,err
+			}
 			value := reflect.Indirect(ind.FieldByName(model.c2n[column])).Interface()
 			setNames, values = append(setNames, column), append(values, value)
 		}
 	}
 
-	table := getTableName(md)
+	q, table, err := o.route(ctx, md, model, false)
+	if err != nil {
+		return 0, err
+	}
 	sep := fmt.Sprintf("%s = ?, %s", TableQuote, TableQuote)
 	setColumns := strings.Join(setNames, sep)
 	query := fmt.Sprintf("UPDATE %s%s%s SET %s%s%s = ? WHERE %s%s%s = ?", TableQuote, table, TableQuote, TableQuote, setColumns, TableQuote, TableQuote, whereCon, TableQuote)
 	values = append(values, whereVal)
-	if !o.isTx {
-		res, err = o.db.Exec(query, values...)
-	} else {
-		res, err = o.tx.Exec(query, values...)
+	old, err := o.readLookups(ctx, q, table, model, setNames, whereCon, whereVal)
+	if err != nil {
+		return 0, err
+	}
+	res, err = o.execWrite(ctx, model, q, query, values...)
+	if err == nil {
+		o.shadowWrite(ctx, md, model, table, query, values...)
+		err = o.saveLookups(ctx, md, model, setNames, old)
 	}
 	
 	if err == nil {
@@ -248,6 +363,11 @@ func (o *orm) Update(md interface{}, cols ...string) (int64, error){
 }
 
 func (o *orm) Delete(md interface{}) (int64, error){
+	return o.DeleteContext(context.Background(), md)
+}
+
+func (o *orm) DeleteContext(ctx context.Context, md interface{}) (int64, error){
+	o.reload()
 	var (
 		column string
 		value interface{}
@@ -256,11 +376,11 @@ func (o *orm) Delete(md interface{}) (int64, error){
 		num int64
 	)
 	fullName := getFullName(md)
-	if _, ok := models[fullName]; !ok {
+	if _, ok := o.topo.models[fullName]; !ok {
 		panic(fmt.Errorf("<orm.Read> unknown model name `%s`", fullName))
 	}
 
-	model := models[fullName]
+	model := o.topo.models[fullName]
 
 	ind := reflect.Indirect(reflect.ValueOf(md))
 
@@ -274,13 +394,20 @@ func (o *orm) Delete(md interface{}) (int64, error){
 		panic(fmt.Errorf("<orm.Read> unknown condition column name `%s`", fullName))
 	}
 
-	table := getTableName(md)
+	q, table, err := o.route(ctx, md, model, false)
+	if err != nil {
+		return 0, err
+	}
 	query := fmt.Sprintf("DELETE FROM %s%s%s WHERE %s%s%s = ? ", TableQuote, table, TableQuote, TableQuote, column, TableQuote)
 
-	if !o.isTx {
-		res, err = o.db.Exec(query, value)
-	} else {
-		res, err = o.tx.Exec(query, value)
+	old, err := o.readLookups(ctx, q, table, model, model.lookups, column, value)
+	if err != nil {
+		return 0, err
+	}
+	res, err = o.execWrite(ctx, model, q, query, value)
+	if err == nil {
+		o.shadowWrite(ctx, md, model, table, query, value)
+		err = o.deleteLookups(ctx, model, old)
 	}
 
 	if err == nil {
@@ -293,85 +420,91 @@ func (o *orm) Delete(md interface{}) (int64, error){
 	return 0, err
 }
 
+// logical table names of sharded models in query are rewritten to the
+// physical ones routed by the shard key in WHERE or VALUES, a statement
+// without shard key runs on every shard, an INSERT without one is refused.
+// it is refused on a migrating bucket since it isn't dual written
 func (o *orm) Exec(query string, args ...interface{}) (sql.Result, error) {
-	if !o.isTx {
-		return o.db.Exec(query, args...)
-	} else {
-		return o.tx.Exec(query, args...)
+	return o.ExecContext(context.Background(), query, args...)
+}
+
+func (o *orm) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	o.reload()
+	m, rts, err := o.routeRaw(query, args, true)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		q, err := o.querier(ctx, o.aliasName)
+		if err != nil {
+			return nil, err
+		}
+		o.wrote(o.aliasName)
+		return q.ExecContext(ctx, query, args...)
 	}
+	return o.execRaw(ctx, m, rts, query, args...)
 }
 
+// query must be routed to a single shard
 func (o *orm) Query(query string, args ...interface{}) (*sql.Rows, error){
-	if !o.isTx {
-		return o.db.Query(query, args...)
-	} else {
-		return o.tx.Query(query, args...)
+	return o.QueryContext(context.Background(), query, args...)
+}
+
+func (o *orm) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error){
+	o.reload()
+	m, rts, err := o.routeRaw(query, args, false)
+	if err != nil {
+		return nil, err
 	}
+	return o.queryRaw(ctx, m, rts, query, args...)
 }
 
+// query routed to several shards is merged like Query2ObjAll
 func (o *orm) Query2Obj(res interface{},query string, args ...interface{}) error {
-    var (
-        ok bool
-        m *modelInfo
-        err error
-        columns []string
-        col string
-        i   int
-    )
-    v:=reflect.ValueOf(res)
-    if v.Kind() != reflect.Ptr || reflect.Indirect(v).Kind() != reflect.Slice {
-        return ErrNoModel
-    }
-    modelsType := reflect.Indirect(v).Type().Elem().String()
-    if m,ok = models[modelsType]; !ok {
-        return ErrUnkownModel
-    }  
-    inds := reflect.Indirect(v)
-    slice := inds
-    rows, err := o.Query(query, args...)
-    if err != nil {
-        return err
-    }
-    defer rows.Close()
-    columns, err = rows.Columns()
-    if err != nil {
-        return err
-    }
-    refs := make([]interface{}, len(columns))
-    for i := range refs {
-        var ref interface{}
-        refs[i] = &ref
-    }
-
-    for rows.Next() {
-        obj := reflect.New(reflect.Indirect(v).Type().Elem())
-        if err = rows.Scan(refs...); err != nil {
-            return err
-        }
-        ind := reflect.Indirect(obj)
-        for i=0; i<len(columns); i++ {
-            col = columns[i]
-            if _,ok = m.c2n[col]; !ok {
-                return ErrUnkownColumn
-            }
-            fieldDes := m.fields[col]
-            valRaw := reflect.Indirect(reflect.ValueOf(refs[i])).Interface()
-            field := ind.FieldByName(m.c2n[col])
-            val := convertValueFromDB(fieldDes, valRaw)
-            setFieldValue(fieldDes, val, field)
-        }
-        slice = reflect.Append(slice,ind)
-    }
-    inds.Set(slice)
-    return nil
+	return o.Query2ObjContext(context.Background(), res, query, args...)
+}
+
+func (o *orm) Query2ObjContext(ctx context.Context, res interface{}, query string, args ...interface{}) error {
+	o.reload()
+	m, slice, err := o.topo.sliceModel(res)
+	if err != nil {
+		return err
+	}
+	rm, rts, err := o.routeRaw(query, args, false)
+	if err != nil {
+		return err
+	}
+	if len(rts) > 1 {
+		return o.scatterRaw(ctx, m, slice, rts, query, args...)
+	}
+	rows, err := o.queryRaw(ctx, rm, rts, query, args...)
+	if err != nil {
+		return err
+	}
+	objs, err := scanRows(rows, m, slice.Type().Elem())
+	if err != nil {
+		return err
+	}
+	slice.Set(reflect.Append(slice, objs...))
+	return nil
 }
 
 func (o *orm) Begin() error {
-	if o.isTx {
+	return o.BeginTx(context.Background(), nil)
+}
+
+// begin a transaction on the alias of orm, it is rolled back by database/sql
+// when ctx is done before Commit
+func (o *orm) BeginTx(ctx context.Context, opts *sql.TxOptions) error {
+	o.reload()
+	if o.isTx || o.xa != nil {
 		return ErrTxHasBegan
 	}
+	if o.db == nil {
+		return ErrNoAlias
+	}
 
-	tx, err := o.db.Begin()
+	tx, err := o.db.BeginTx(ctx, opts)
 	if err != nil {
 		return err
 	}
@@ -381,6 +514,9 @@ func (o *orm) Begin() error {
 }
 func (o *orm) Commit() error {
 	var err error
+	if o.xa != nil {
+		return o.commitXA()
+	}
 	if o.isTx == false {
 		return ErrTxDone
 	}
@@ -388,17 +524,25 @@ func (o *orm) Commit() error {
 	if err == nil {
 		o.isTx = false
 		o.tx = nil
+		o.flushShadows()
 		//err = o.Using(o.aliasName)
-	} else if err == sql.ErrTxDone {
+		return nil
+	}
+	o.shadows = nil
+	if err == sql.ErrTxDone {
 		return ErrTxDone
 	}
 	return err
 }
 func (o *orm) Rollback() error {
 	var err error
+	if o.xa != nil {
+		return o.rollbackXA()
+	}
 	if o.isTx == false {
 		return ErrTxDone
 	}
+	o.shadows = nil
 	err = o.tx.Rollback()
 	if err == nil {
 		o.isTx = false
@@ -0,0 +1,304 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// separator of column and operator in the expression of Filter, `age__gt`
+const ExprSep = "__"
+
+// query builder of md, conditions are joined by AND:
+//   var users []User
+//   n, err := o.QueryTable(&User{}).Filter("age__gt", 18).OrderBy("-created").Limit(10).All(&users)
+// operators are exact (default), gt, gte, lt, lte, in, isnull, contains,
+// startswith and endswith. `key` or `key__in` of the shard column routes to
+// its shards, otherwise the query goes to every shard and ORDER BY/LIMIT are
+// applied after merge
+func (o *orm) QueryTable(md interface{}) QuerySeter {
+	o.reload()
+	qs := &querySet{o: o, ctx: context.Background(), typ: reflect.Indirect(reflect.ValueOf(md)).Type()}
+	fullName := getFullName(md)
+	if m, ok := o.topo.models[fullName]; ok {
+		qs.model = m
+	} else {
+		qs.err = fmt.Errorf("<orm.QueryTable> unknown model name `%s`", fullName)
+	}
+	return qs
+}
+
+type querySet struct {
+	o      *orm
+	model  *modelInfo
+	typ    reflect.Type
+	ctx    context.Context
+	conds  []string
+	args   []interface{}
+	orders []string
+	limit  int64
+	offset int64
+	err    error
+}
+
+func (qs querySet) Filter(expr string, args ...interface{}) QuerySeter {
+	return qs.where(false, expr, args)
+}
+
+func (qs querySet) Exclude(expr string, args ...interface{}) QuerySeter {
+	return qs.where(true, expr, args)
+}
+
+// order by columns, `-column` is descending
+func (qs querySet) OrderBy(exprs ...string) QuerySeter {
+	if qs.err != nil {
+		return &qs
+	}
+	orders := make([]string, 0, len(exprs))
+	for _, expr := range exprs {
+		desc := strings.HasPrefix(expr, "-")
+		column, err := qs.column(strings.TrimPrefix(expr, "-"))
+		if err != nil {
+			qs.err = err
+			return &qs
+		}
+		order := TableQuote + column + TableQuote
+		if desc {
+			order += " DESC"
+		}
+		orders = append(orders, order)
+	}
+	qs.orders = orders
+	return &qs
+}
+
+func (qs querySet) Limit(limit int64) QuerySeter {
+	qs.limit = limit
+	return &qs
+}
+
+// offset of the first row, used with Limit
+func (qs querySet) Offset(offset int64) QuerySeter {
+	qs.offset = offset
+	return &qs
+}
+
+func (qs querySet) WithContext(ctx context.Context) QuerySeter {
+	qs.ctx = ctx
+	return &qs
+}
+
+// count of rows matched, Limit and Offset are ignored
+func (qs querySet) Count() (int64, error) {
+	if qs.err != nil {
+		return 0, qs.err
+	}
+	o := qs.o
+	query, args := qs.sql("COUNT(*)")
+	m, rts, err := o.routeRaw(query, args, false)
+	if err != nil {
+		return 0, err
+	}
+	if len(rts) <= 1 {
+		rows, err := o.queryRaw(qs.ctx, m, rts, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		var n int64
+		if rows.Next() {
+			err = rows.Scan(&n)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		return n, err
+	}
+
+	counts := make([]int64, len(rts))
+	err = o.scatter(qs.ctx, rawTargets(m, rts), func(i int, q sqlQuerier, t Target) error {
+		rq, rargs := rts[i].rewrite(query, args)
+		return q.QueryRowContext(qs.ctx, rq, rargs...).Scan(&counts[i])
+	})
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, c := range counts {
+		n += c
+	}
+	return n, nil
+}
+
+// whether any row matches, errors are taken as no row
+func (qs querySet) Exist() bool {
+	if qs.err != nil {
+		return false
+	}
+	qs.limit, qs.offset = 1, 0
+	res := reflect.New(reflect.SliceOf(qs.typ))
+	n, err := qs.All(res.Interface())
+	return err == nil && n > 0
+}
+
+// append the rows matched to res, a pointer to slice of the model, and
+// return the number of rows appended
+func (qs querySet) All(res interface{}) (int64, error) {
+	if qs.err != nil {
+		return 0, qs.err
+	}
+	if qs.offset > 0 && qs.limit <= 0 {
+		return 0, fmt.Errorf("<QuerySeter> Offset without Limit")
+	}
+	query, args := qs.sql(qs.model.columns)
+	if len(qs.orders) > 0 {
+		query += " ORDER BY " + strings.Join(qs.orders, ColumnDelim+" ")
+	}
+	if qs.limit > 0 {
+		query += " LIMIT "
+		if qs.offset > 0 {
+			query += strconv.FormatInt(qs.offset, 10) + ColumnDelim + " "
+		}
+		query += strconv.FormatInt(qs.limit, 10)
+	}
+
+	slice := reflect.Indirect(reflect.ValueOf(res))
+	var before int
+	if slice.Kind() == reflect.Slice {
+		before = slice.Len()
+	}
+	err := qs.o.Query2ObjContext(qs.ctx, res, query, args...)
+	if slice.Kind() != reflect.Slice {
+		return 0, err
+	}
+	return int64(slice.Len() - before), err
+}
+
+// read the single row matched into md, ErrNoRows or ErrMultiRows if not
+// exactly one
+func (qs querySet) One(md interface{}) error {
+	if qs.err != nil {
+		return qs.err
+	}
+	val := reflect.ValueOf(md)
+	if val.Kind() != reflect.Ptr || reflect.Indirect(val).Type() != qs.typ {
+		return fmt.Errorf("<QuerySeter.One> md must be pointer of `%s`", qs.typ)
+	}
+	qs.limit = 2
+	res := reflect.New(reflect.SliceOf(qs.typ))
+	n, err := qs.All(res.Interface())
+	if err != nil {
+		return err
+	}
+	switch n {
+	case 0:
+		return ErrNoRows
+	case 1:
+		val.Elem().Set(res.Elem().Index(0))
+		return nil
+	}
+	return ErrMultiRows
+}
+
+// add the condition of expr, the slices are copied so that the QuerySeter
+// it is derived from is unchanged
+func (qs querySet) where(not bool, expr string, args []interface{}) QuerySeter {
+	if qs.err != nil {
+		return &qs
+	}
+	cond, vals, err := qs.cond(expr, args)
+	if err != nil {
+		qs.err = err
+		return &qs
+	}
+	if not {
+		cond = "NOT (" + cond + ")"
+	}
+	qs.conds = append(qs.conds[:len(qs.conds):len(qs.conds)], cond)
+	qs.args = append(qs.args[:len(qs.args):len(qs.args)], vals...)
+	return &qs
+}
+
+// sql condition and args of a Filter expression
+func (qs querySet) cond(expr string, args []interface{}) (string, []interface{}, error) {
+	name, op := expr, "exact"
+	if i := strings.LastIndex(expr, ExprSep); i > 0 {
+		name, op = expr[:i], expr[i+len(ExprSep):]
+	}
+	column, err := qs.column(name)
+	if err != nil {
+		return "", nil, err
+	}
+	column = TableQuote + column + TableQuote
+
+	if op == "in" {
+		if len(args) == 1 {
+			if v := reflect.ValueOf(args[0]); (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() != reflect.Uint8 {
+				args = make([]interface{}, v.Len())
+				for i := range args {
+					args[i] = v.Index(i).Interface()
+				}
+			}
+		}
+		if len(args) == 0 {
+			return "", nil, fmt.Errorf("<QuerySeter> `%s` needs at least one value", expr)
+		}
+		marks := strings.TrimRight(strings.Repeat(PrepareDelim+ColumnDelim+" ", len(args)), ColumnDelim+" ")
+		return column + " IN (" + marks + ")", args, nil
+	}
+	if len(args) != 1 {
+		return "", nil, fmt.Errorf("<QuerySeter> `%s` needs one value", expr)
+	}
+
+	value := args[0]
+	switch op {
+	case "exact":
+		if value == nil {
+			return column + " IS NULL", nil, nil
+		}
+		return column + " = ?", args, nil
+	case "gt":
+		return column + " > ?", args, nil
+	case "gte":
+		return column + " >= ?", args, nil
+	case "lt":
+		return column + " < ?", args, nil
+	case "lte":
+		return column + " <= ?", args, nil
+	case "isnull":
+		if isNull, _ := value.(bool); isNull {
+			return column + " IS NULL", nil, nil
+		}
+		return column + " IS NOT NULL", nil, nil
+	case "contains":
+		return column + " LIKE ?", []interface{}{"%" + escapeLike(ToStr(value)) + "%"}, nil
+	case "startswith":
+		return column + " LIKE ?", []interface{}{escapeLike(ToStr(value)) + "%"}, nil
+	case "endswith":
+		return column + " LIKE ?", []interface{}{"%" + escapeLike(ToStr(value))}, nil
+	}
+	return "", nil, fmt.Errorf("<QuerySeter> unknown operator `%s` in `%s`", op, expr)
+}
+
+// column of a column or field name of the model
+func (qs querySet) column(name string) (string, error) {
+	if column, ok := qs.model.column(name); ok {
+		return column, nil
+	}
+	return "", fmt.Errorf("<QuerySeter> unknown column name `%s`", name)
+}
+
+// SELECT of the logical table with the conditions
+func (qs querySet) sql(selects string) (string, []interface{}) {
+	query := fmt.Sprintf("SELECT %s FROM %s%s%s", selects, TableQuote, qs.model.table, TableQuote)
+	if len(qs.conds) > 0 {
+		query += " WHERE " + strings.Join(qs.conds, " AND ")
+	}
+	return query, qs.args
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,60 @@
+package sharding
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuerySetCond(t *testing.T) {
+	qs := querySet{model: &modelInfo{
+		c2n: map[string]string{"id": "Id", "user_name": "Name"},
+		n2c: map[string]string{"Id": "id", "Name": "user_name"},
+	}}
+	cases := []struct {
+		expr string
+		args []interface{}
+		cond string
+		vals []interface{}
+	}{
+		{"id", []interface{}{1}, "`id` = ?", []interface{}{1}},
+		{"Id__exact", []interface{}{nil}, "`id` IS NULL", nil},
+		{"id__gt", []interface{}{1}, "`id` > ?", []interface{}{1}},
+		{"id__gte", []interface{}{1}, "`id` >= ?", []interface{}{1}},
+		{"id__lt", []interface{}{1}, "`id` < ?", []interface{}{1}},
+		{"id__lte", []interface{}{1}, "`id` <= ?", []interface{}{1}},
+		{"id__in", []interface{}{1, 2}, "`id` IN (?, ?)", []interface{}{1, 2}},
+		{"id__in", []interface{}{[]int64{1, 2, 3}}, "`id` IN (?, ?, ?)", []interface{}{int64(1), int64(2), int64(3)}},
+		{"user_name__in", []interface{}{[]byte("a")}, "`user_name` IN (?)", []interface{}{[]byte("a")}},
+		{"Name__isnull", []interface{}{true}, "`user_name` IS NULL", nil},
+		{"Name__isnull", []interface{}{false}, "`user_name` IS NOT NULL", nil},
+		{"Name__contains", []interface{}{"50%_a"}, "`user_name` LIKE ?", []interface{}{`%50\%\_a%`}},
+		{"Name__startswith", []interface{}{`a\b`}, "`user_name` LIKE ?", []interface{}{`a\\b%`}},
+		{"Name__endswith", []interface{}{"b"}, "`user_name` LIKE ?", []interface{}{"%b"}},
+	}
+	for _, c := range cases {
+		cond, vals, err := qs.cond(c.expr, c.args)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if cond != c.cond || !reflect.DeepEqual(vals, c.vals) {
+			t.Errorf("%s: got %q %v, want %q %v", c.expr, cond, vals, c.cond, c.vals)
+		}
+	}
+
+	for _, c := range []struct {
+		expr string
+		args []interface{}
+	}{
+		{"age", []interface{}{1}},
+		{"id__like", []interface{}{1}},
+		{"id", nil},
+		{"id__gt", []interface{}{1, 2}},
+		{"id__in", nil},
+		{"id__in", []interface{}{[]int{}}},
+	} {
+		if _, _, err := qs.cond(c.expr, c.args); err == nil {
+			t.Errorf("%s %v: want error", c.expr, c.args)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// physical shard of a raw statement, tables maps logical table names
+// referenced by the statement to physical ones
+type rawTarget struct {
+	alias  string
+	tables map[string]string
+	keys   []interface{}
+	in     *inList
+	keep   []int
+}
+
+// `IN (...)` list of the shard column, items are the token index of values
+type inList struct {
+	open  int
+	close int
+	items []int
+}
+
+// result of a statement executed on several shards
+type multiResult struct {
+	lastId   int64
+	affected int64
+}
+
+func (r multiResult) LastInsertId() (int64, error) { return r.lastId, nil }
+func (r multiResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+// rewrite the logical table names of query for target, the IN list of the
+// shard column keeps only the values routed to target
+func (t rawTarget) rewrite(query string, args []interface{}) (string, []interface{}) {
+	toks := tokenize(query)
+	for logical, physical := range t.tables {
+		if logical == physical {
+			continue
+		}
+		for _, i := range tableRefs(toks, logical) {
+			toks[i] = token{kind: tokQuoted, text: TableQuote + physical + TableQuote}
+		}
+	}
+	if t.in == nil || len(t.keep) == len(t.in.items) {
+		return joinTokens(toks), args
+	}
+
+	var drop []int
+	for _, i := range t.in.items {
+		if toks[i].kind == tokArg && !hasInt(t.keep, i) {
+			drop = append(drop, argIndex(toks, i))
+		}
+	}
+	list := make([]token, 0, len(toks))
+	list = append(list, toks[:t.in.open+1]...)
+	for n, i := range t.keep {
+		if n > 0 {
+			list = append(list, token{kind: tokSymbol, text: ","}, token{kind: tokSpace, text: " "})
+		}
+		list = append(list, toks[i])
+	}
+	list = append(list, toks[t.in.close:]...)
+
+	kept := make([]interface{}, 0, len(args))
+	for i, arg := range args {
+		if !hasInt(drop, i) {
+			kept = append(kept, arg)
+		}
+	}
+	return joinTokens(list), kept
+}
+
+// route a raw statement referencing logical tables of registered sharded
+// models. the shard key is taken from `key = value` or `key IN (...)` in a
+// WHERE without OR, or from the VALUES of INSERT, without it the statement
+// goes to every shard. nil targets mean no sharded table is referenced and
+// the statement runs on the alias of orm, or a write of broadcast model
+// that goes to every alias
+func (o *orm) routeRaw(query string, args []interface{}, write bool) (*modelInfo, []rawTarget, error) {
+	toks := tokenize(query)
+	var (
+		refs      []*modelInfo
+		broadcast *modelInfo
+	)
+	for _, m := range o.topo.sortedModels() {
+		if o.topo.strategy(m) == nil || len(tableRefs(toks, m.table)) == 0 {
+			continue
+		}
+		if _, ok := o.topo.strategy(m).(*BroadcastStrategy); ok {
+			broadcast = m
+			continue
+		}
+		refs = append(refs, m)
+	}
+	if len(refs) == 0 {
+		if broadcast == nil || write {
+			return broadcast, nil, nil
+		}
+		alias, err := o.broadcastAlias(o.topo.strategy(broadcast).(*BroadcastStrategy), broadcast.table)
+		if err != nil {
+			return nil, nil, err
+		}
+		return broadcast, []rawTarget{{alias: alias, tables: map[string]string{broadcast.table: broadcast.table}}}, nil
+	}
+
+	// a model bound to another one without lookup follows its shards
+	m := refs[0]
+	for _, r := range refs {
+		if b, ok := o.topo.strategy(r).(*BindStrategy); !ok || b.lookup != nil {
+			m = r
+			break
+		}
+	}
+	var bound []*modelInfo
+	for _, other := range refs {
+		if other == m {
+			continue
+		}
+		if b, ok := o.topo.strategy(other).(*BindStrategy); !ok || b.lookup != nil || b.parent != m.fullName {
+			return nil, nil, fmt.Errorf("<orm> raw sql references sharded tables `%s` and `%s` not bound to each other", m.table, other.table)
+		}
+		bound = append(bound, other)
+	}
+
+	var in *inList
+	keys, ok := insertKeys(toks, m, args)
+	if !ok {
+		keys, in, ok = whereKeys(toks, m.shard, args)
+	}
+	if !ok {
+		// an INSERT run on every shard would duplicate its rows
+		if write && isInsert(toks) {
+			return nil, nil, fmt.Errorf("<orm> no shard key `%s` in VALUES of INSERT into `%s`", m.shard, m.table)
+		}
+		targets, err := o.topo.strategy(m).Shards(m.table)
+		if err != nil {
+			return nil, nil, err
+		}
+		rts := make([]rawTarget, 0, len(targets))
+		for i, t := range targets {
+			rt := rawTarget{alias: t.Alias, tables: map[string]string{m.table: t.Table}}
+			for _, other := range bound {
+				ts, err := o.topo.strategy(other).Shards(other.table)
+				if err != nil {
+					return nil, nil, err
+				}
+				if len(ts) != len(targets) {
+					return nil, nil, fmt.Errorf("<orm> shards of `%s` and `%s` mismatch", m.table, other.table)
+				}
+				rt.tables[other.table] = ts[i].Table
+			}
+			rts = append(rts, o.resolveTarget(rt))
+		}
+		return m, rts, nil
+	}
+
+	var rts []rawTarget
+	for k, key := range keys {
+		alias, table, err := o.topo.strategy(m).Shard(m.table, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		rt := o.resolveTarget(rawTarget{alias: alias, tables: map[string]string{m.table: table}, in: in})
+		for _, other := range bound {
+			if _, rt.tables[other.table], err = o.topo.strategy(other).Shard(other.table, key); err != nil {
+				return nil, nil, err
+			}
+		}
+		found := false
+		for i := range rts {
+			if rts[i].alias == rt.alias && rts[i].tables[m.table] == table {
+				rts[i].keys = append(rts[i].keys, key)
+				if in != nil {
+					rts[i].keep = append(rts[i].keep, in.items[k])
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			rt.keys = []interface{}{key}
+			if in != nil {
+				rt.keep = []int{in.items[k]}
+			}
+			rts = append(rts, rt)
+		}
+	}
+	if write && len(rts) > 1 && isInsert(toks) {
+		return nil, nil, fmt.Errorf("<orm> rows of INSERT go to different shards of `%s`", m.table)
+	}
+	return m, rts, nil
+}
+
+// empty alias is the alias of orm
+func (o *orm) resolveTarget(rt rawTarget) rawTarget {
+	if len(rt.alias) == 0 {
+		rt.alias = o.aliasName
+	}
+	return rt
+}
+
+// exec a raw statement on every shard it is routed to
+func (o *orm) execRaw(ctx context.Context, m *modelInfo, rts []rawTarget, query string, args ...interface{}) (sql.Result, error) {
+	if _, ok := o.topo.strategy(m).(*BroadcastStrategy); ok && rts == nil {
+		return o.execWrite(ctx, m, nil, query, args...)
+	}
+	if s, ok := o.topo.strategy(m).(shadowStrategy); ok {
+		// raw writes aren't dual written, a migrating bucket would miss them
+		for _, rt := range rts {
+			if s.isMigrating(rt.keys) {
+				return nil, fmt.Errorf("<orm> raw write on migrating bucket of `%s`, use Insert, Update or Delete", m.table)
+			}
+		}
+	}
+	var res multiResult
+	for _, rt := range rts {
+		q, err := o.querier(ctx, rt.alias)
+		if err != nil {
+			return nil, err
+		}
+		o.wrote(rt.alias)
+		rq, rargs := rt.rewrite(query, args)
+		r, err := q.ExecContext(ctx, rq, rargs...)
+		if err != nil {
+			return nil, err
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		res.affected += n
+		if id, err := r.LastInsertId(); err == nil && id > 0 {
+			res.lastId = id
+		}
+	}
+	return res, nil
+}
+
+// query on the single shard of rts, no targets run on the alias of orm
+func (o *orm) queryRaw(ctx context.Context, m *modelInfo, rts []rawTarget, query string, args ...interface{}) (*sql.Rows, error) {
+	if len(rts) > 1 {
+		return nil, fmt.Errorf("<orm.Query> sql goes to %d shards of `%s`, use Query2Obj or Query2ObjAll", len(rts), m.table)
+	}
+	alias := o.aliasName
+	if len(rts) == 1 {
+		alias = rts[0].alias
+		query, args = rts[0].rewrite(query, args)
+	}
+	q, err := o.reader(ctx, alias)
+	if err != nil {
+		return nil, err
+	}
+	return q.QueryContext(ctx, query, args...)
+}
+
+// query every shard of rts and merge the rows into slice like Query2ObjAll
+func (o *orm) scatterRaw(ctx context.Context, m *modelInfo, slice reflect.Value, rts []rawTarget, query string, args ...interface{}) error {
+	query, args, p, err := parsePagination(query, args)
+	if err != nil {
+		return err
+	}
+	parts := make([][]reflect.Value, len(rts))
+	err = o.scatter(ctx, rawTargets(m, rts), func(i int, q sqlQuerier, t Target) error {
+		rq, rargs := rts[i].rewrite(query, args)
+		rows, err := q.QueryContext(ctx, rq, rargs...)
+		if err != nil {
+			return err
+		}
+		parts[i], err = scanRows(rows, m, slice.Type().Elem())
+		return err
+	})
+	objs, merr := mergeRows(parts, m, p)
+	if merr != nil {
+		return merr
+	}
+	slice.Set(reflect.Append(slice, objs...))
+	return err
+}
+
+// physical shards of model in rts
+func rawTargets(m *modelInfo, rts []rawTarget) []Target {
+	targets := make([]Target, len(rts))
+	for i, rt := range rts {
+		targets[i] = Target{Alias: rt.alias, Table: rt.tables[m.table]}
+	}
+	return targets
+}
+
+// keys of the shard column in WHERE, only `key = value` and `key IN (...)`
+// joined by AND at the top level are used
+func whereKeys(toks []token, column string, args []interface{}) ([]interface{}, *inList, bool) {
+	start, end := whereClause(toks)
+	if start < 0 || findKeyword(toks[start:end], 0, "OR") >= 0 {
+		return nil, nil, false
+	}
+	depth := 0
+	for i := start; i < end; i++ {
+		t := toks[i]
+		switch {
+		case t.text == "(":
+			depth++
+		case t.text == ")":
+			depth--
+		case depth == 0 && (t.kind == tokIdent || t.kind == tokQuoted) && t.name() == column:
+			n := nextToken(toks, i)
+			if n < 0 {
+				continue
+			}
+			if toks[n].text == "=" {
+				if v, ok := literal(toks, nextToken(toks, n), args); ok {
+					return []interface{}{v}, nil, true
+				}
+			} else if toks[n].is("IN") {
+				if in := inItems(toks, n); in != nil {
+					keys := make([]interface{}, 0, len(in.items))
+					for _, item := range in.items {
+						v, ok := literal(toks, item, args)
+						if !ok {
+							return nil, nil, false
+						}
+						keys = append(keys, v)
+					}
+					return keys, in, true
+				}
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// bounds of the top level WHERE clause, -1 if none
+func whereClause(toks []token) (int, int) {
+	w := findKeyword(toks, 0, "WHERE")
+	if w < 0 {
+		return -1, -1
+	}
+	end := len(toks)
+	for _, kw := range []string{"GROUP", "HAVING", "ORDER", "LIMIT", "FOR", "LOCK"} {
+		if i := findKeyword(toks, w, kw); i >= 0 && i < end {
+			end = i
+		}
+	}
+	return w + 1, end
+}
+
+// list of `IN (...)` at in, nil if an item is not a single value
+func inItems(toks []token, in int) *inList {
+	open := nextToken(toks, in)
+	if open < 0 || toks[open].text != "(" {
+		return nil
+	}
+	close := matchParen(toks, open)
+	if close < 0 {
+		return nil
+	}
+	var items []int
+	for i := open; i < close; {
+		v := nextToken(toks, i)
+		sep := nextToken(toks, v)
+		if v < 0 || sep < 0 || (toks[sep].text != "," && sep != close) {
+			return nil
+		}
+		items = append(items, v)
+		i = sep
+	}
+	return &inList{open: open, close: close, items: items}
+}
+
+// keys of the shard column in VALUES of INSERT/REPLACE
+func insertKeys(toks []token, m *modelInfo, args []interface{}) ([]interface{}, bool) {
+	if !isInsert(toks) {
+		return nil, false
+	}
+	refs := tableRefs(toks, m.table)
+	if len(refs) == 0 {
+		return nil, false
+	}
+	open := nextToken(toks, refs[0])
+	if open < 0 || toks[open].text != "(" {
+		return nil, false
+	}
+	close := matchParen(toks, open)
+	if close < 0 {
+		return nil, false
+	}
+	index := -1
+	for i, col := range splitTokens(toks[open+1:close], ",") {
+		if c := nextToken(col, -1); c >= 0 && col[c].name() == m.shard {
+			index = i
+		}
+	}
+	values := nextToken(toks, close)
+	if index < 0 || values < 0 || !(toks[values].is("VALUES") || toks[values].is("VALUE")) {
+		return nil, false
+	}
+
+	var keys []interface{}
+	for i := nextToken(toks, values); i >= 0 && toks[i].text == "("; {
+		end := matchParen(toks, i)
+		if end < 0 {
+			return nil, false
+		}
+		n := 0
+		for k := i + 1; k < end; k++ {
+			if toks[k].text == "(" {
+				if k = matchParen(toks, k); k < 0 {
+					return nil, false
+				}
+				continue
+			}
+			if toks[k].text == "," {
+				n++
+				continue
+			}
+			if n == index && toks[k].kind != tokSpace {
+				v, ok := literal(toks, k, args)
+				if !ok {
+					return nil, false
+				}
+				keys = append(keys, v)
+				break
+			}
+		}
+		if i = nextToken(toks, end); i < 0 || toks[i].text != "," {
+			break
+		}
+		i = nextToken(toks, i)
+	}
+	return keys, len(keys) > 0
+}
+
+func isInsert(toks []token) bool {
+	first := nextToken(toks, -1)
+	return first >= 0 && (toks[first].is("INSERT") || toks[first].is("REPLACE"))
+}
+
+// value of a literal or placeholder token
+func literal(toks []token, i int, args []interface{}) (interface{}, bool) {
+	if i < 0 {
+		return nil, false
+	}
+	t := toks[i]
+	switch t.kind {
+	case tokNumber:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return n, true
+		}
+		return t.text, true
+	case tokString:
+		quote := t.text[:1]
+		s := strings.TrimSuffix(t.text[1:], quote)
+		s = strings.Replace(s, quote+quote, quote, -1)
+		s = strings.Replace(s, `\`+quote, quote, -1)
+		return s, true
+	case tokArg:
+		if n := argIndex(toks, i); n < len(args) {
+			return shardKey(args[n]), true
+		}
+	}
+	return nil, false
+}
+
+// normalize a shard key value to the types of model fields
+func shardKey(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	}
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	return value
+}
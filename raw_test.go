@@ -0,0 +1,96 @@
+package sharding
+
+import (
+	"reflect"
+	"testing"
+)
+
+var rawModel = &modelInfo{table: "order", shard: "user_id"}
+
+func TestInsertKeys(t *testing.T) {
+	cases := []struct {
+		query string
+		args  []interface{}
+		keys  []interface{}
+		ok    bool
+	}{
+		{"INSERT INTO `order` (`id`, `user_id`) VALUES (1, 7)", nil, []interface{}{int64(7)}, true},
+		{"INSERT INTO order (user_id, note) VALUES (?, ?), (?, ?)", []interface{}{7, "a", uint8(8), "b"},
+			[]interface{}{int64(7), uint64(8)}, true},
+		{"REPLACE INTO order (id, user_id) VALUE (NOW(), '7')", nil, []interface{}{"7"}, true},
+		{"INSERT INTO order (id, user_id) VALUES (CONCAT('a', 'b'), ?)", []interface{}{int64(9)}, []interface{}{int64(9)}, true},
+		{"INSERT INTO order (id) VALUES (1)", nil, nil, false},
+		{"INSERT INTO order (id, user_id) SELECT id, user_id FROM t", nil, nil, false},
+		{"INSERT INTO order (id, user_id) VALUES (1, UUID())", nil, nil, false},
+		{"INSERT INTO order (id, user_id VALUES (1, 2)", nil, nil, false},
+		{"INSERT INTO order (id, user_id) VALUES ((1, 2)", nil, nil, false},
+		{"UPDATE order SET user_id = 1", nil, nil, false},
+	}
+	for _, c := range cases {
+		keys, ok := insertKeys(tokenize(c.query), rawModel, c.args)
+		if ok != c.ok || !reflect.DeepEqual(keys, c.keys) {
+			t.Errorf("%q: got %v %v, want %v %v", c.query, keys, ok, c.keys, c.ok)
+		}
+	}
+}
+
+func TestWhereKeys(t *testing.T) {
+	cases := []struct {
+		query string
+		args  []interface{}
+		keys  []interface{}
+		items int
+		ok    bool
+	}{
+		{"SELECT * FROM order WHERE user_id = ?", []interface{}{7}, []interface{}{int64(7)}, 0, true},
+		{"SELECT * FROM order WHERE status = 1 AND `user_id` IN (?, 8, '9') ORDER BY id", []interface{}{7},
+			[]interface{}{int64(7), int64(8), "9"}, 3, true},
+		{"SELECT * FROM order WHERE (user_id = 1 OR user_id = 2)", nil, nil, 0, false},
+		{"SELECT * FROM order WHERE user_id IN (SELECT user_id FROM t)", nil, nil, 0, false},
+		{"SELECT * FROM order WHERE user_id IN (1, 2", nil, nil, 0, false},
+		{"SELECT * FROM order WHERE user_id > 1", nil, nil, 0, false},
+		{"SELECT * FROM order", nil, nil, 0, false},
+	}
+	for _, c := range cases {
+		keys, in, ok := whereKeys(tokenize(c.query), rawModel.shard, c.args)
+		items := 0
+		if in != nil {
+			items = len(in.items)
+		}
+		if ok != c.ok || !reflect.DeepEqual(keys, c.keys) || items != c.items {
+			t.Errorf("%q: got %v %d %v, want %v %d %v", c.query, keys, items, ok, c.keys, c.items, c.ok)
+		}
+	}
+}
+
+func TestRawTargetRewrite(t *testing.T) {
+	query := "SELECT * FROM order WHERE status = ? AND user_id IN (?, 8, ?, 10) LIMIT ?"
+	args := []interface{}{1, 7, 9, 5}
+	toks := tokenize(query)
+	_, in, ok := whereKeys(toks, "user_id", args)
+	if !ok {
+		t.Fatal("no IN list")
+	}
+	cases := []struct {
+		keep  []int
+		query string
+		args  []interface{}
+	}{
+		{in.items, "SELECT * FROM `order_01` WHERE status = ? AND user_id IN (?, 8, ?, 10) LIMIT ?", args},
+		{[]int{in.items[0], in.items[2]}, "SELECT * FROM `order_01` WHERE status = ? AND user_id IN (?, ?) LIMIT ?", []interface{}{1, 7, 9, 5}},
+		{[]int{in.items[1], in.items[3]}, "SELECT * FROM `order_01` WHERE status = ? AND user_id IN (8, 10) LIMIT ?", []interface{}{1, 5}},
+		{[]int{in.items[2]}, "SELECT * FROM `order_01` WHERE status = ? AND user_id IN (?) LIMIT ?", []interface{}{1, 9, 5}},
+	}
+	for i, c := range cases {
+		rt := rawTarget{tables: map[string]string{"order": "order_01"}, in: in, keep: c.keep}
+		q, a := rt.rewrite(query, args)
+		if q != c.query || !reflect.DeepEqual(a, c.args) {
+			t.Errorf("case %d: got %q %v, want %q %v", i, q, a, c.query, c.args)
+		}
+	}
+
+	rt := rawTarget{tables: map[string]string{"order": "order"}}
+	if q, a := rt.rewrite(query, args); q != query || !reflect.DeepEqual(a, args) {
+		t.Errorf("unchanged target: got %q %v", q, a)
+	}
+}
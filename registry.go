@@ -0,0 +1,96 @@
+package sharding
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+)
+
+// registry of databases, models and strategies. reads take the current
+// snapshot without lock, writes are serialized and swap in a changed copy,
+// so registering is safe while orm of the registry run. the package level
+// functions use a default registry
+type Registry struct {
+	// serializes writers
+	mu   sync.Mutex
+	topo atomic.Value
+}
+
+// strategy or id generator using the dbs and models of the registry it is
+// registered in, the default registry until then
+type registryBinder interface {
+	bindRegistry(r *Registry)
+}
+
+var defaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	r := new(Registry)
+	r.topo.Store(newTopology())
+	return r
+}
+
+// the default registry used by package level functions
+func DefaultRegistry() *Registry {
+	return defaultRegistry
+}
+
+func (r *Registry) load() *topology {
+	return r.topo.Load().(*topology)
+}
+
+// change a copy of the current snapshot and swap it in, dbs no longer used
+// are closed after DrainTimeout
+func (r *Registry) update(fn func(t *topology) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.load()
+	t := old.clone()
+	if err := fn(t); err != nil {
+		return err
+	}
+	r.topo.Store(t)
+
+	used := make(map[*sql.DB]bool, len(t.dbs))
+	for _, db := range t.all() {
+		used[db] = true
+	}
+	for _, db := range old.all() {
+		if !used[db] {
+			drain(db)
+		}
+	}
+	return nil
+}
+
+// bind v to the registry when it depends on one
+func (r *Registry) bind(v interface{}) interface{} {
+	if b, ok := v.(registryBinder); ok {
+		b.bindRegistry(r)
+	}
+	return v
+}
+
+// strategies reading their state from a db alias when they are registered
+type topologyLoader interface {
+	load(t *topology) error
+}
+
+// bind a strategy to r and load its state from t
+func (r *Registry) bindStrategy(t *topology, s ShardStrategy) (ShardStrategy, error) {
+	s = r.bind(s).(ShardStrategy)
+	if l, ok := s.(topologyLoader); ok {
+		if err := l.load(t); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// registry of a strategy, nil means the default one
+func registryOf(r *Registry) *Registry {
+	if r == nil {
+		return defaultRegistry
+	}
+	return r
+}
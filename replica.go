@@ -0,0 +1,305 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ReplicaRoundRobin = iota
+	ReplicaLeastConn
+)
+
+// policy choosing the replica of a read, round robin by default. least
+// connections picks the replica with the fewest connections in use
+func (r *Registry) SetReplicaPolicy(policy int) error {
+	if policy != ReplicaRoundRobin && policy != ReplicaLeastConn {
+		return fmt.Errorf("<sharding.SetReplicaPolicy> unknown policy `%d`", policy)
+	}
+	return r.update(func(t *topology) error {
+		t.replicaPolicy = policy
+		return nil
+	})
+}
+
+func SetReplicaPolicy(policy int) error {
+	return defaultRegistry.SetReplicaPolicy(policy)
+}
+
+// replicas lagging behind more than lag are skipped until they catch up,
+// reads fall back to the primary when every replica lags. it is a second by
+// default
+func (r *Registry) SetMaxReplicaLag(lag time.Duration) error {
+	return r.update(func(t *topology) error {
+		t.maxLag = lag
+		return nil
+	})
+}
+
+func SetMaxReplicaLag(lag time.Duration) error {
+	return defaultRegistry.SetMaxReplicaLag(lag)
+}
+
+// table updated every moment on primary by a heartbeat writer, lag is
+// measured by its latest `ts` when set, otherwise by SHOW SLAVE STATUS
+func (r *Registry) SetLagHeartbeatTable(table string) error {
+	return r.update(func(t *topology) error {
+		t.heartbeat = table
+		return nil
+	})
+}
+
+func SetLagHeartbeatTable(table string) error {
+	return defaultRegistry.SetLagHeartbeatTable(table)
+}
+
+// replicas of a primary alias, a set is replaced instead of changed except
+// the measured lag in nanoseconds of every replica
+type replicaSet struct {
+	dbs  []*sql.DB
+	dsns []string
+	lags []int64
+	next uint32
+}
+
+func (s *replicaSet) add(db *sql.DB, dsn string, lag int64) *replicaSet {
+	c := &replicaSet{
+		dbs:  make([]*sql.DB, 0, len(s.dbs)+1),
+		dsns: make([]string, 0, len(s.dsns)+1),
+		lags: make([]int64, len(s.lags), len(s.lags)+1),
+	}
+	c.dbs = append(append(c.dbs, s.dbs...), db)
+	c.dsns = append(append(c.dsns, s.dsns...), dsn)
+	for i := range s.lags {
+		c.lags[i] = atomic.LoadInt64(&s.lags[i])
+	}
+	c.lags = append(c.lags, lag)
+	return c
+}
+
+func (s *replicaSet) lag(i int) time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.lags[i]))
+}
+
+// a replica within maxLag by policy, nil if none
+func (s *replicaSet) pick(policy int, maxLag time.Duration) *sql.DB {
+	if policy == ReplicaLeastConn {
+		var (
+			best  *sql.DB
+			inUse int
+		)
+		for i, db := range s.dbs {
+			if s.lag(i) > maxLag {
+				continue
+			}
+			if n := db.Stats().InUse; best == nil || n < inUse {
+				best, inUse = db, n
+			}
+		}
+		return best
+	}
+	n := int(atomic.AddUint32(&s.next, 1) - 1)
+	for k := range s.dbs {
+		i := (n + k) % len(s.dbs)
+		if s.lag(i) <= maxLag {
+			return s.dbs[i]
+		}
+	}
+	return nil
+}
+
+//register a read replica of alias, reads outside transaction go to the
+//replicas of alias and writes stay on it
+func RegisterReplica(aliasName, dataSource string, params ...int) error {
+	return defaultRegistry.RegisterReplica(aliasName, dataSource, params...)
+}
+
+func (r *Registry) RegisterReplica(aliasName, dataSource string, params ...int) error {
+	if _, ok := r.load().dbs[aliasName]; !ok {
+		return fmt.Errorf("<sharding.RegisterReplica> unknown db alias name `%s`", aliasName)
+	}
+	db, err := openDataBase(aliasName, dataSource)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range params {
+		switch i {
+		case 0:
+			db.SetMaxIdleConns(v)
+		case 1:
+			db.SetMaxOpenConns(v)
+		}
+	}
+
+	err = r.update(func(t *topology) error {
+		if _, ok := t.dbs[aliasName]; !ok {
+			return fmt.Errorf("<sharding.RegisterReplica> unknown db alias name `%s`", aliasName)
+		}
+		s, ok := t.replicas[aliasName]
+		if !ok {
+			s = new(replicaSet)
+		}
+		t.replicas[aliasName] = s.add(db, dataSource, 0)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+	}
+	return err
+}
+
+// querier of a read, a replica of alias outside transaction unless orm
+// forces primary or wrote alias within its read-your-writes window
+func (o *orm) reader(ctx context.Context, alias string) (sqlQuerier, error) {
+	if o.isTx || o.xa != nil || o.primary {
+		return o.querier(ctx, alias)
+	}
+	if t, ok := o.writes[alias]; ok && time.Since(t) < o.window {
+		return o.querier(ctx, alias)
+	}
+	if s, ok := o.topo.replicas[alias]; ok {
+		if db := s.pick(o.topo.replicaPolicy, o.topo.maxLag); db != nil {
+			return db, nil
+		}
+	}
+	return o.querier(ctx, alias)
+}
+
+// reads of an alias go to the primary within window after orm wrote it,
+// zero window turns it off
+func (o *orm) ReadYourWrites(window time.Duration) {
+	o.window = window
+}
+
+// record a write on alias for read-your-writes
+func (o *orm) wrote(alias string) {
+	if o.window <= 0 {
+		return
+	}
+	if o.writes == nil {
+		o.writes = make(map[string]time.Time)
+	}
+	o.writes[alias] = time.Now()
+}
+
+// measure the lag of every replica once, a replica failed to measure is
+// skipped until measured again
+func (r *Registry) MeasureLag() error {
+	var failed []string
+	t := r.load()
+	for alias, s := range t.replicas {
+		for i, db := range s.dbs {
+			lag, err := replicaLag(db, t.heartbeat)
+			if err != nil {
+				lag = math.MaxInt64
+				failed = append(failed, fmt.Sprintf("%s replica %d: %s", alias, i, err.Error()))
+			}
+			atomic.StoreInt64(&s.lags[i], int64(lag))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("<sharding.MeasureLag> %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func MeasureLag() error {
+	return defaultRegistry.MeasureLag()
+}
+
+// measure replica lag every interval until stop is called,
+// errors are passed to onError if not nil
+func (r *Registry) MonitorLag(interval time.Duration, onError func(error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := r.MeasureLag(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func MonitorLag(interval time.Duration, onError func(error)) (stop func()) {
+	return defaultRegistry.MonitorLag(interval, onError)
+}
+
+// lag of replica by the heartbeat table if set, stopped replication is an
+// error
+func replicaLag(db *sql.DB, heartbeat string) (time.Duration, error) {
+	if len(heartbeat) > 0 {
+		var lag sql.NullFloat64
+		query := fmt.Sprintf("SELECT UNIX_TIMESTAMP(NOW(6)) - UNIX_TIMESTAMP(MAX(`ts`)) FROM %s%s%s", TableQuote, heartbeat, TableQuote)
+		if err := db.QueryRow(query).Scan(&lag); err != nil {
+			return 0, err
+		}
+		if !lag.Valid {
+			return 0, fmt.Errorf("no heartbeat in `%s`", heartbeat)
+		}
+		return time.Duration(lag.Float64 * float64(time.Second)), nil
+	}
+
+	rows, err := db.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("not a replica")
+	}
+	vals := make([]sql.NullString, len(columns))
+	refs := make([]interface{}, len(columns))
+	for i := range vals {
+		refs[i] = &vals[i]
+	}
+	if err = rows.Scan(refs...); err != nil {
+		return 0, err
+	}
+	for i, column := range columns {
+		if column != "Seconds_Behind_Master" && column != "Seconds_Behind_Source" {
+			continue
+		}
+		if !vals[i].Valid {
+			return 0, fmt.Errorf("replication stopped")
+		}
+		seconds, err := strconv.ParseInt(vals[i].String, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, fmt.Errorf("no Seconds_Behind_Master in SHOW SLAVE STATUS")
+}
+
+// copy of orm reading from the primary, for a read right after a write:
+//   o.Primary().Read(&user)
+// the copy is meant for a single call, begin transactions on orm itself
+func (o *orm) Primary() Eorm {
+	c := *o
+	c.primary = true
+	return &c
+}
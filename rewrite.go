@@ -0,0 +1,168 @@
+package sharding
+
+import (
+	"strings"
+)
+
+const (
+	tokSpace = iota
+	tokIdent
+	tokQuoted
+	tokString
+	tokNumber
+	tokArg
+	tokSymbol
+)
+
+// sql token, the text of all tokens joined is the origin sql
+type token struct {
+	kind int
+	text string
+}
+
+// name of identifier without quote
+func (t token) name() string {
+	if t.kind == tokQuoted {
+		return strings.Trim(t.text, TableQuote)
+	}
+	return t.text
+}
+
+// whether token is the keyword, case insensitive
+func (t token) is(keyword string) bool {
+	return t.kind == tokIdent && strings.EqualFold(t.text, keyword)
+}
+
+// split sql into tokens, comments are kept as space
+func tokenize(query string) []token {
+	var toks []token
+	for i := 0; i < len(query); {
+		c := query[i]
+		j := i + 1
+		kind := tokSymbol
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			for j < len(query) && strings.IndexByte(" \t\n\r", query[j]) >= 0 {
+				j++
+			}
+			kind = tokSpace
+		case c == '#' || (c == '-' && strings.HasPrefix(query[i:], "-- ")):
+			if k := strings.IndexByte(query[i:], '\n'); k >= 0 {
+				j = i + k
+			} else {
+				j = len(query)
+			}
+			kind = tokSpace
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			if k := strings.Index(query[i+2:], "*/"); k >= 0 {
+				j = i + k + 4
+			} else {
+				j = len(query)
+			}
+			kind = tokSpace
+		case c == '\'' || c == '"' || c == '`':
+			for j < len(query) {
+				if query[j] == '\\' && c != '`' {
+					j += 2
+					continue
+				}
+				if query[j] == c {
+					if j+1 < len(query) && query[j+1] == c {
+						j += 2
+						continue
+					}
+					j++
+					break
+				}
+				j++
+			}
+			if j > len(query) {
+				j = len(query)
+			}
+			kind = tokString
+			if c == '`' {
+				kind = tokQuoted
+			}
+		case c == '?':
+			kind = tokArg
+		case c >= '0' && c <= '9':
+			for j < len(query) && (isIdentByte(query[j]) || query[j] == '.') {
+				j++
+			}
+			kind = tokNumber
+		case isIdentByte(c):
+			for j < len(query) && isIdentByte(query[j]) {
+				j++
+			}
+			kind = tokIdent
+		case strings.IndexByte("<>!", c) >= 0 && j < len(query) && strings.IndexByte("=>", query[j]) >= 0:
+			j++
+		}
+		toks = append(toks, token{kind: kind, text: query[i:j]})
+		i = j
+	}
+	return toks
+}
+
+func joinTokens(toks []token) string {
+	var buf strings.Builder
+	for _, t := range toks {
+		buf.WriteString(t.text)
+	}
+	return buf.String()
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+// next non space token index after i, -1 if none
+func nextToken(toks []token, i int) int {
+	for i++; i < len(toks); i++ {
+		if toks[i].kind != tokSpace {
+			return i
+		}
+	}
+	return -1
+}
+
+// previous non space token index before i, -1 if none
+func prevToken(toks []token, i int) int {
+	for i--; i >= 0; i-- {
+		if toks[i].kind != tokSpace {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexes of tokens refer to table, a table name follows FROM, JOIN,
+// UPDATE, INTO or qualifies a column as `table`.`column`
+func tableRefs(toks []token, table string) []int {
+	var refs []int
+	for i, t := range toks {
+		if (t.kind != tokIdent && t.kind != tokQuoted) || t.name() != table {
+			continue
+		}
+		if n := nextToken(toks, i); n >= 0 && toks[n].text == "." {
+			refs = append(refs, i)
+			continue
+		}
+		if p := prevToken(toks, i); p >= 0 && toks[p].text != "." {
+			prev := toks[p]
+			if prev.is("FROM") || prev.is("JOIN") || prev.is("UPDATE") || prev.is("INTO") {
+				refs = append(refs, i)
+			}
+		}
+	}
+	return refs
+}
+
+// replace the logical table name in query with the physical one
+func replaceTable(query, table, physical string) string {
+	toks := tokenize(query)
+	for _, i := range tableRefs(toks, table) {
+		toks[i] = token{kind: tokQuoted, text: TableQuote + physical + TableQuote}
+	}
+	return joinTokens(toks)
+}
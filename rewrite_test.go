@@ -0,0 +1,60 @@
+package sharding
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	cases := []struct {
+		query string
+		kinds []int
+		texts []string
+	}{
+		{"SELECT 1", []int{tokIdent, tokSpace, tokNumber}, []string{"SELECT", " ", "1"}},
+		{"a>=?", []int{tokIdent, tokSymbol, tokArg}, []string{"a", ">=", "?"}},
+		{"`order`.id", []int{tokQuoted, tokSymbol, tokIdent}, []string{"`order`", ".", "id"}},
+		{`'it''s' "a\"b"`, []int{tokString, tokSpace, tokString}, []string{`'it''s'`, " ", `"a\"b"`}},
+		{"a -- note\nb", []int{tokIdent, tokSpace, tokSpace, tokSpace, tokIdent}, []string{"a", " ", "-- note", "\n", "b"}},
+		{"a/* x */b", []int{tokIdent, tokSpace, tokIdent}, []string{"a", "/* x */", "b"}},
+		{"1.5e", []int{tokNumber}, []string{"1.5e"}},
+		{"'open", []int{tokString}, []string{"'open"}},
+	}
+	for _, c := range cases {
+		toks := tokenize(c.query)
+		if joinTokens(toks) != c.query {
+			t.Errorf("%q: joined to %q", c.query, joinTokens(toks))
+		}
+		var (
+			kinds []int
+			texts []string
+		)
+		for _, tok := range toks {
+			kinds, texts = append(kinds, tok.kind), append(texts, tok.text)
+		}
+		if !reflect.DeepEqual(kinds, c.kinds) || !reflect.DeepEqual(texts, c.texts) {
+			t.Errorf("%q: got %v %q, want %v %q", c.query, kinds, texts, c.kinds, c.texts)
+		}
+	}
+}
+
+func TestReplaceTable(t *testing.T) {
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM order WHERE id = 1", "SELECT * FROM `order_01` WHERE id = 1"},
+		{"SELECT order.id FROM `order` JOIN item ON order.id = item.order_id",
+			"SELECT `order_01`.id FROM `order_01` JOIN item ON `order_01`.id = item.order_id"},
+		{"UPDATE order SET status = 'order' WHERE id = ?", "UPDATE `order_01` SET status = 'order' WHERE id = ?"},
+		{"INSERT INTO `order` (id) VALUES (1)", "INSERT INTO `order_01` (id) VALUES (1)"},
+		{"SELECT order FROM t", "SELECT order FROM t"},
+		{"SELECT * FROM orders", "SELECT * FROM orders"},
+		{"SELECT * FROM db.order", "SELECT * FROM db.order"},
+	}
+	for _, c := range cases {
+		if got := replaceTable(c.query, "order", "order_01"); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.query, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package sharding
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// consistent hash ring strategy, shard key values are mapped onto db
+// aliases by murmur3, every alias owns replicas*weight virtual nodes.
+// with Tables > 0 the table is table_NN, NN = hash % Tables
+type HashRing struct {
+	mu       sync.RWMutex
+	replicas int
+	tables   int
+	weights  map[string]int
+	hashes   []uint32
+	owners   map[uint32]string
+}
+
+// a shard key moved between aliases
+type KeyMove struct {
+	Key  interface{}
+	From string
+	To   string
+}
+
+func NewHashRing(replicas, tables int) *HashRing {
+	if replicas <= 0 {
+		panic(fmt.Errorf("<sharding.NewHashRing> replicas must be positive"))
+	}
+	return &HashRing{
+		replicas: replicas,
+		tables:   tables,
+		weights:  make(map[string]int),
+		owners:   make(map[uint32]string),
+	}
+}
+
+// add alias with weight, or change the weight of it
+func (r *HashRing) AddNode(alias string, weight int) error {
+	if weight <= 0 {
+		return fmt.Errorf("<HashRing.AddNode> weight of `%s` must be positive", alias)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.weights[alias] = weight
+	r.build()
+	return nil
+}
+
+func (r *HashRing) RemoveNode(alias string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.weights, alias)
+	r.build()
+}
+
+// alias owns the shard key value
+func (r *HashRing) Node(value interface{}) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.node(murmur3([]byte(ToStr(value)), 0))
+}
+
+func (r *HashRing) Shard(table string, value interface{}) (string, string, error) {
+	h := murmur3([]byte(ToStr(value)), 0)
+	r.mu.RLock()
+	alias, err := r.node(h)
+	r.mu.RUnlock()
+	if err != nil {
+		return "", "", err
+	}
+	if r.tables > 0 {
+		table = tableSuffix(table, uint64(h)%uint64(r.tables), r.tables)
+	}
+	return alias, table, nil
+}
+
+func (r *HashRing) Shards(table string) ([]Target, error) {
+	r.mu.RLock()
+	aliases := make([]string, 0, len(r.weights))
+	for alias := range r.weights {
+		aliases = append(aliases, alias)
+	}
+	r.mu.RUnlock()
+	sort.Strings(aliases)
+
+	var targets []Target
+	for _, alias := range aliases {
+		if r.tables <= 0 {
+			targets = append(targets, Target{Alias: alias, Table: table})
+			continue
+		}
+		for n := 0; n < r.tables; n++ {
+			targets = append(targets, Target{Alias: alias, Table: tableSuffix(table, uint64(n), r.tables)})
+		}
+	}
+	return targets, nil
+}
+
+// keys which move to alias if it is added with weight, used to plan migration
+func (r *HashRing) PlanAdd(alias string, weight int, keys []interface{}) ([]KeyMove, error) {
+	next := r.clone()
+	if err := next.AddNode(alias, weight); err != nil {
+		return nil, err
+	}
+	return r.moves(next, keys)
+}
+
+// keys which move away from alias if it is removed
+func (r *HashRing) PlanRemove(alias string, keys []interface{}) ([]KeyMove, error) {
+	next := r.clone()
+	next.RemoveNode(alias)
+	return r.moves(next, keys)
+}
+
+// copy of ring with the same nodes, virtual nodes are built by AddNode/RemoveNode
+func (r *HashRing) clone() *HashRing {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	next := NewHashRing(r.replicas, r.tables)
+	for alias, weight := range r.weights {
+		next.weights[alias] = weight
+	}
+	return next
+}
+
+func (r *HashRing) moves(next *HashRing, keys []interface{}) ([]KeyMove, error) {
+	var moves []KeyMove
+	for _, key := range keys {
+		from, err := r.Node(key)
+		if err != nil {
+			return nil, err
+		}
+		to, err := next.Node(key)
+		if err != nil {
+			return nil, err
+		}
+		if from != to {
+			moves = append(moves, KeyMove{Key: key, From: from, To: to})
+		}
+	}
+	return moves, nil
+}
+
+// rebuild virtual nodes, must hold the write lock
+func (r *HashRing) build() {
+	r.hashes = r.hashes[:0]
+	r.owners = make(map[uint32]string)
+	aliases := make([]string, 0, len(r.weights))
+	for alias := range r.weights {
+		aliases = append(aliases, alias)
+	}
+	// same order for every build so collided virtual nodes keep the owner
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		for i := 0; i < r.replicas*r.weights[alias]; i++ {
+			h := murmur3([]byte(alias+"#"+strconv.Itoa(i)), 0)
+			if _, ok := r.owners[h]; ok {
+				continue
+			}
+			r.owners[h] = alias
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// first virtual node clockwise from h, must hold the read lock
+func (r *HashRing) node(h uint32) (string, error) {
+	if len(r.hashes) == 0 {
+		return "", fmt.Errorf("<HashRing> no node in ring")
+	}
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]], nil
+}
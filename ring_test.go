@@ -0,0 +1,134 @@
+package sharding
+
+import (
+	"testing"
+)
+
+func TestMurmur3(t *testing.T) {
+	cases := []struct {
+		data string
+		seed uint32
+		want uint32
+	}{
+		{"", 0, 0},
+		{"", 1, 0x514e28b7},
+		{"", 0xffffffff, 0x81f16f39},
+		{"\x00\x00\x00\x00", 0, 0x2362f9de},
+		{"a", 0x9747b28c, 0x7fa09ea6},
+		{"abc", 0, 0xb3dd93fa},
+		{"aaaa", 0x9747b28c, 0x5a97808a},
+		{"Hello, world!", 0x9747b28c, 0x24884cba},
+		{"The quick brown fox jumps over the lazy dog", 0, 0x2e4ff723},
+	}
+	for _, c := range cases {
+		if got := murmur3([]byte(c.data), c.seed); got != c.want {
+			t.Errorf("murmur3(%q, %#x) = %#x, want %#x", c.data, c.seed, got, c.want)
+		}
+	}
+}
+
+func newTestRing(t *testing.T, aliases ...string) *HashRing {
+	r := NewHashRing(100, 0)
+	for _, alias := range aliases {
+		if err := r.AddNode(alias, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func ringKeys(n int) []interface{} {
+	keys := make([]interface{}, n)
+	for i := range keys {
+		keys[i] = int64(i)
+	}
+	return keys
+}
+
+func TestHashRingPlanAdd(t *testing.T) {
+	r := newTestRing(t, "db_0", "db_1", "db_2")
+	keys := ringKeys(10000)
+	before := make(map[interface{}]string, len(keys))
+	for _, key := range keys {
+		before[key], _ = r.Node(key)
+	}
+
+	moves, err := r.PlanAdd("db_3", 1, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only keys taken by the new node move, about a quarter of them
+	if n := len(moves); n < len(keys)/8 || n > len(keys)*3/8 {
+		t.Errorf("%d of %d keys move, want about a quarter", n, len(keys))
+	}
+	for _, m := range moves {
+		if m.To != "db_3" || m.From != before[m.Key] {
+			t.Errorf("bad move %+v", m)
+		}
+	}
+
+	// the plan doesn't change the ring, adding the node matches it
+	for _, key := range keys {
+		if alias, _ := r.Node(key); alias != before[key] {
+			t.Fatalf("PlanAdd changed the owner of %v", key)
+		}
+	}
+	r.AddNode("db_3", 1)
+	moved := make(map[interface{}]bool, len(moves))
+	for _, m := range moves {
+		moved[m.Key] = true
+	}
+	for _, key := range keys {
+		alias, _ := r.Node(key)
+		if (alias != before[key]) != moved[key] {
+			t.Errorf("key %v: owner %s, before %s, planned move %v", key, alias, before[key], moved[key])
+		}
+	}
+}
+
+func TestHashRingPlanRemove(t *testing.T) {
+	r := newTestRing(t, "db_0", "db_1", "db_2", "db_3")
+	keys := ringKeys(10000)
+	owned := 0
+	for _, key := range keys {
+		if alias, _ := r.Node(key); alias == "db_2" {
+			owned++
+		}
+	}
+	moves, err := r.PlanRemove("db_2", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != owned {
+		t.Errorf("%d keys move, want the %d owned by db_2", len(moves), owned)
+	}
+	for _, m := range moves {
+		if m.From != "db_2" || m.To == "db_2" {
+			t.Errorf("bad move %+v", m)
+		}
+	}
+}
+
+func TestHashRingShard(t *testing.T) {
+	r := NewHashRing(10, 4)
+	if _, _, err := r.Shard("order", 1); err == nil {
+		t.Error("empty ring: want error")
+	}
+	r.AddNode("db_0", 1)
+	r.AddNode("db_1", 2)
+	for _, key := range ringKeys(100) {
+		alias, table, err := r.Shard("order", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, _ := r.Node(key)
+		want := tableSuffix("order", uint64(murmur3([]byte(ToStr(key)), 0))%4, 4)
+		if alias != node || table != want {
+			t.Errorf("key %v: got %s.%s, want %s.%s", key, alias, table, node, want)
+		}
+	}
+	targets, _ := r.Shards("order")
+	if len(targets) != 8 || targets[0] != (Target{"db_0", "order_00"}) || targets[7] != (Target{"db_1", "order_03"}) {
+		t.Errorf("bad targets %v", targets)
+	}
+}
@@ -0,0 +1,142 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// max number of shards queried at the same time by scatter-gather
+var ScatterParallel = 8
+
+// error of a physical shard
+type ShardError struct {
+	Alias string
+	Table string
+	Err   error
+}
+
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("<%s.%s> %s", e.Alias, e.Table, e.Err.Error())
+}
+
+// errors of scatter-gather, one for each failed shard
+type ScatterError []*ShardError
+
+func (e ScatterError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("<orm> %d shard(s) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// run query on every physical shard of the model of res, the logical table
+// name in query is replaced by the physical one. ORDER BY results are merge
+// sorted and LIMIT is applied to the merged result. results of succeed
+// shards are appended to res even if a ScatterError is returned
+func (o *orm) Query2ObjAll(res interface{}, query string, args ...interface{}) error {
+	return o.Query2ObjAllContext(context.Background(), res, query, args...)
+}
+
+func (o *orm) Query2ObjAllContext(ctx context.Context, res interface{}, query string, args ...interface{}) error {
+	o.reload()
+	m, slice, err := o.topo.sliceModel(res)
+	if err != nil {
+		return err
+	}
+	targets, err := o.shards(m)
+	if err != nil {
+		return err
+	}
+
+	query, args, p, err := parsePagination(query, args)
+	if err != nil {
+		return err
+	}
+
+	parts := make([][]reflect.Value, len(targets))
+	err = o.scatter(ctx, targets, func(i int, q sqlQuerier, t Target) error {
+		rows, err := q.QueryContext(ctx, replaceTable(query, m.table, t.Table), args...)
+		if err != nil {
+			return err
+		}
+		parts[i], err = scanRows(rows, m, slice.Type().Elem())
+		return err
+	})
+	objs, merr := mergeRows(parts, m, p)
+	if merr != nil {
+		return merr
+	}
+	slice.Set(reflect.Append(slice, objs...))
+	return err
+}
+
+// physical shards of model, empty alias is the alias of orm
+func (o *orm) shards(m *modelInfo) ([]Target, error) {
+	s := o.topo.strategy(m)
+	if s == nil {
+		return []Target{{Alias: o.aliasName, Table: m.table}}, nil
+	}
+	if b, ok := s.(*BroadcastStrategy); ok {
+		alias, err := o.broadcastAlias(b, m.table)
+		if err != nil {
+			return nil, err
+		}
+		return []Target{{Alias: alias, Table: m.table}}, nil
+	}
+	targets, err := s.Shards(m.table)
+	if err != nil {
+		return nil, err
+	}
+	for i := range targets {
+		if len(targets[i].Alias) == 0 {
+			targets[i].Alias = o.aliasName
+		}
+	}
+	return targets, nil
+}
+
+// run fn on every target with at most ScatterParallel goroutines,
+// the errors of failed shards are returned as ScatterError
+func (o *orm) scatter(ctx context.Context, targets []Target, fn func(i int, q sqlQuerier, t Target) error) error {
+	parallel := ScatterParallel
+	if parallel <= 0 || o.isTx || o.xa != nil {
+		// statements of a transaction share one connection
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(targets))
+	sem := make(chan struct{}, parallel)
+	for i, t := range targets {
+		q, err := o.reader(ctx, t.Alias)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, q sqlQuerier, t Target) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = fn(i, q, t)
+		}(i, q, t)
+	}
+	wg.Wait()
+
+	var se ScatterError
+	for i, err := range errs {
+		if err != nil {
+			se = append(se, &ShardError{Alias: targets[i].Alias, Table: targets[i].Table, Err: err})
+		}
+	}
+	if len(se) > 0 {
+		return se
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+const (
+	TableSuffixDelim = "_"
+)
+
+//register modulo routing of a model tagged with `shard(column)`,
+//same as RegisterModel(md, NewModStrategy(tables))
+func RegisterShardRule(md interface{}, tables int) {
+	defaultRegistry.RegisterShardRule(md, tables)
+}
+
+func (r *Registry) RegisterShardRule(md interface{}, tables int) {
+	fullName := getFullName(md)
+	err := r.update(func(t *topology) error {
+		model, ok := t.models[fullName]
+		if !ok {
+			return fmt.Errorf("<sharding.RegisterShardRule> unknown model name `%s`", fullName)
+		}
+		if len(model.shard) == 0 {
+			return fmt.Errorf("<sharding.RegisterShardRule> model `%s` have no shard column, may be miss setting tag", fullName)
+		}
+		t.strategies[fullName] = NewModStrategy(tables)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// resolve db and physical table of model instance, the db alias comes from
+// the strategy and falls back to the alias of orm. read goes to a replica
+func (o *orm) route(ctx context.Context, md interface{}, model *modelInfo, read bool) (sqlQuerier, string, error) {
+	alias, table := o.aliasName, getTableName(md)
+	if b, ok := o.topo.strategy(model).(*BroadcastStrategy); ok {
+		a, err := o.broadcastAlias(b, model.table)
+		if err != nil {
+			return nil, "", err
+		}
+		alias, table = a, model.table
+	} else if s := o.topo.strategy(model); s != nil {
+		var value interface{}
+		if len(model.shard) > 0 {
+			value = shardValue(md, model)
+		}
+		a, t, err := s.Shard(model.table, value)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(a) > 0 {
+			alias = a
+		}
+		table = t
+	}
+
+	if read {
+		q, err := o.reader(ctx, alias)
+		return q, table, err
+	}
+	q, err := o.querier(ctx, alias)
+	if err == nil {
+		o.wrote(alias)
+	}
+	return q, table, err
+}
+
+// get db of alias, or the transaction when it began on alias,
+// or the branch of alias in distributed transaction
+func (o *orm) querier(ctx context.Context, alias string) (sqlQuerier, error) {
+	if o.xa != nil {
+		return o.xa.branch(ctx, alias)
+	}
+	if o.isTx {
+		if alias != o.aliasName {
+			return nil, fmt.Errorf("<orm> transaction began on `%s`, can't route to `%s`", o.aliasName, alias)
+		}
+		return o.tx, nil
+	}
+	if len(alias) == 0 {
+		return nil, ErrNoAlias
+	}
+	db, ok := o.topo.dbs[alias]
+	if !ok {
+		return nil, fmt.Errorf("<orm> unknown db alias name `%s`", alias)
+	}
+	return db, nil
+}
+
+// get shard key value of model instance
+func shardValue(md interface{}, model *modelInfo) interface{} {
+	ind := reflect.Indirect(reflect.ValueOf(md))
+	return reflect.Indirect(ind.FieldByName(model.c2n[model.shard])).Interface()
+}
+
+// convert shard key value to an unsigned number, strings which are not
+// numeric are hashed by crc32
+func shardNumber(value interface{}) (uint64, error) {
+	switch v := value.(type) {
+	case int64:
+		if v < 0 {
+			return 0, fmt.Errorf("<sharding> negative shard key value `%d`", v)
+		}
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case string:
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			return n, nil
+		}
+		return uint64(crc32.ChecksumIEEE([]byte(v))), nil
+	}
+	return 0, fmt.Errorf("<sharding> unsupport shard key type `%T`", value)
+}
+
+// convert shard key value to a signed number
+func shardInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, fmt.Errorf("<sharding> shard key value `%d` overflow", v)
+		}
+		return int64(v), nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("<sharding> shard key value `%s` is not number", v)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("<sharding> unsupport shard key type `%T`", value)
+}
@@ -0,0 +1,314 @@
+package sharding
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+	"strconv"
+	"time"
+)
+
+const (
+	HashCRC32 = iota
+	HashMurmur3
+)
+
+const (
+	DateDaily = iota
+	DateMonthly
+)
+
+// sharding strategy, map the shard key value of a model to db alias and
+// physical table. empty alias means the alias used by orm.
+// Shards list every physical shard of table for scatter-gather
+type ShardStrategy interface {
+	Shard(table string, value interface{}) (alias string, physical string, err error)
+	Shards(table string) ([]Target, error)
+}
+
+// a physical shard
+type Target struct {
+	Alias string
+	Table string
+}
+
+// physical table = table_NN, NN = shard key value % tables.
+// with aliases the db is aliases[shard key value % len(aliases)]
+type ModStrategy struct {
+	Tables  int
+	Aliases []string
+}
+
+func NewModStrategy(tables int, aliases ...string) *ModStrategy {
+	if tables <= 0 {
+		panic(fmt.Errorf("<sharding.NewModStrategy> tables must be positive"))
+	}
+	return &ModStrategy{Tables: tables, Aliases: aliases}
+}
+
+func (s *ModStrategy) Shard(table string, value interface{}) (string, string, error) {
+	n, err := shardNumber(value)
+	if err != nil {
+		return "", "", err
+	}
+	return pickAlias(s.Aliases, n), tableSuffix(table, n%uint64(s.Tables), s.Tables), nil
+}
+
+func (s *ModStrategy) Shards(table string) ([]Target, error) {
+	return cycleTargets(table, s.Tables, s.Aliases), nil
+}
+
+// physical table = table_NN, NN = hash(shard key value) % tables.
+// with aliases the db is aliases[hash % len(aliases)]
+type HashStrategy struct {
+	Tables  int
+	Hash    int
+	Aliases []string
+}
+
+func NewHashStrategy(tables int, hash int, aliases ...string) *HashStrategy {
+	if tables <= 0 {
+		panic(fmt.Errorf("<sharding.NewHashStrategy> tables must be positive"))
+	}
+	if hash != HashCRC32 && hash != HashMurmur3 {
+		panic(fmt.Errorf("<sharding.NewHashStrategy> unknown hash `%d`", hash))
+	}
+	return &HashStrategy{Tables: tables, Hash: hash, Aliases: aliases}
+}
+
+func (s *HashStrategy) Shard(table string, value interface{}) (string, string, error) {
+	n := uint64(hashValue(s.Hash, value))
+	return pickAlias(s.Aliases, n), tableSuffix(table, n%uint64(s.Tables), s.Tables), nil
+}
+
+func (s *HashStrategy) Shards(table string) ([]Target, error) {
+	return cycleTargets(table, s.Tables, s.Aliases), nil
+}
+
+// numeric range [Start, End) mapped to table_Suffix on Alias
+type Range struct {
+	Start  int64
+	End    int64
+	Suffix string
+	Alias  string
+}
+
+type RangeStrategy struct {
+	Ranges []Range
+}
+
+func NewRangeStrategy(ranges ...Range) *RangeStrategy {
+	for i, r := range ranges {
+		if r.Start >= r.End {
+			panic(fmt.Errorf("<sharding.NewRangeStrategy> range %d start must less than end", i))
+		}
+	}
+	return &RangeStrategy{Ranges: ranges}
+}
+
+func (s *RangeStrategy) Shard(table string, value interface{}) (string, string, error) {
+	n, err := shardInt(value)
+	if err != nil {
+		return "", "", err
+	}
+	for _, r := range s.Ranges {
+		if n >= r.Start && n < r.End {
+			return r.Alias, table + TableSuffixDelim + r.Suffix, nil
+		}
+	}
+	return "", "", fmt.Errorf("<RangeStrategy> no range found for shard key value `%d`", n)
+}
+
+func (s *RangeStrategy) Shards(table string) ([]Target, error) {
+	targets := make([]Target, 0, len(s.Ranges))
+	for _, r := range s.Ranges {
+		target := Target{Alias: r.Alias, Table: table + TableSuffixDelim + r.Suffix}
+		if !hasTarget(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+// time bucketed tables, table_20060102 for daily and table_200601 for monthly.
+// shard key value is unix seconds or a string formatted as DateLayouts.
+// Start and End bound the tables visited by scatter-gather
+type DateStrategy struct {
+	Bucket   int
+	Alias    string
+	Location *time.Location
+	Start    time.Time
+	End      time.Time
+}
+
+var DateLayouts = []string{"2006-01-02 15:04:05", "2006-01-02"}
+
+func NewDateStrategy(bucket int) *DateStrategy {
+	if bucket != DateDaily && bucket != DateMonthly {
+		panic(fmt.Errorf("<sharding.NewDateStrategy> unknown bucket `%d`", bucket))
+	}
+	return &DateStrategy{Bucket: bucket, Location: time.Local}
+}
+
+func (s *DateStrategy) Shard(table string, value interface{}) (string, string, error) {
+	t, err := s.time(value)
+	if err != nil {
+		return "", "", err
+	}
+	return s.Alias, table + TableSuffixDelim + s.suffix(t), nil
+}
+
+func (s *DateStrategy) Shards(table string) ([]Target, error) {
+	if s.Start.IsZero() || s.End.IsZero() || s.End.Before(s.Start) {
+		return nil, fmt.Errorf("<DateStrategy> invalid Start/End to list shards of `%s`", table)
+	}
+	var targets []Target
+	last := s.suffix(s.End.In(s.location()))
+	for t := s.Start.In(s.location()); ; {
+		suffix := s.suffix(t)
+		targets = append(targets, Target{Alias: s.Alias, Table: table + TableSuffixDelim + suffix})
+		if suffix == last {
+			break
+		}
+		if s.Bucket == DateMonthly {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		} else {
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+	return targets, nil
+}
+
+func (s *DateStrategy) location() *time.Location {
+	if s.Location == nil {
+		return time.Local
+	}
+	return s.Location
+}
+
+func (s *DateStrategy) time(value interface{}) (time.Time, error) {
+	loc := s.location()
+	switch v := value.(type) {
+	case int64:
+		return time.Unix(v, 0).In(loc), nil
+	case uint64:
+		return time.Unix(int64(v), 0).In(loc), nil
+	case string:
+		for _, layout := range DateLayouts {
+			if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("<DateStrategy> unknown date format `%s`", v)
+	}
+	return time.Time{}, fmt.Errorf("<DateStrategy> unsupport shard key type `%T`", value)
+}
+
+func (s *DateStrategy) suffix(t time.Time) string {
+	if s.Bucket == DateMonthly {
+		return t.Format("200601")
+	}
+	return t.Format("20060102")
+}
+
+// table_NN, NN is zero padded to the width of tables-1 and at least 2
+func tableSuffix(table string, n uint64, tables int) string {
+	width := len(strconv.Itoa(tables - 1))
+	if width < 2 {
+		width = 2
+	}
+	return fmt.Sprintf("%s%s%0*d", table, TableSuffixDelim, width, n)
+}
+
+// targets of table_NN on aliases, a shard key value n always lives in
+// the n % lcm(tables, aliases) one
+func cycleTargets(table string, tables int, aliases []string) []Target {
+	cycle := tables
+	if len(aliases) > 0 {
+		cycle = tables / gcd(tables, len(aliases)) * len(aliases)
+	}
+	targets := make([]Target, 0, cycle)
+	for n := uint64(0); n < uint64(cycle); n++ {
+		target := Target{Alias: pickAlias(aliases, n), Table: tableSuffix(table, n%uint64(tables), tables)}
+		if !hasTarget(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+func hasTarget(targets []Target, target Target) bool {
+	for _, t := range targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func pickAlias(aliases []string, n uint64) string {
+	if len(aliases) == 0 {
+		return ""
+	}
+	return aliases[n%uint64(len(aliases))]
+}
+
+func hashValue(hash int, value interface{}) uint32 {
+	data := []byte(ToStr(value))
+	if hash == HashMurmur3 {
+		return murmur3(data, 0)
+	}
+	return crc32.ChecksumIEEE(data)
+}
+
+// murmur3 x86 32 bit
+func murmur3(data []byte, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+	h := seed
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[n*4:]
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,169 @@
+package sharding
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTableSuffix(t *testing.T) {
+	cases := []struct {
+		n      uint64
+		tables int
+		want   string
+	}{
+		{0, 1, "order_00"},
+		{3, 4, "order_03"},
+		{9, 10, "order_09"},
+		{10, 11, "order_10"},
+		{7, 100, "order_07"},
+		{42, 101, "order_042"},
+		{999, 1000, "order_999"},
+	}
+	for _, c := range cases {
+		if got := tableSuffix("order", c.n, c.tables); got != c.want {
+			t.Errorf("tableSuffix(%d, %d) = %s, want %s", c.n, c.tables, got, c.want)
+		}
+	}
+}
+
+func TestCycleTargets(t *testing.T) {
+	cases := []struct {
+		tables  int
+		aliases []string
+		want    []Target
+	}{
+		{2, nil, []Target{{"", "t_00"}, {"", "t_01"}}},
+		{4, []string{"a", "b"}, []Target{{"a", "t_00"}, {"b", "t_01"}, {"a", "t_02"}, {"b", "t_03"}}},
+		// lcm(2, 3) = 6, every table lives on every alias
+		{2, []string{"a", "b", "c"}, []Target{
+			{"a", "t_00"}, {"b", "t_01"}, {"c", "t_00"},
+			{"a", "t_01"}, {"b", "t_00"}, {"c", "t_01"},
+		}},
+		// lcm(4, 6) = 12
+		{4, []string{"a", "b", "c", "d", "e", "f"}, []Target{
+			{"a", "t_00"}, {"b", "t_01"}, {"c", "t_02"}, {"d", "t_03"},
+			{"e", "t_00"}, {"f", "t_01"}, {"a", "t_02"}, {"b", "t_03"},
+			{"c", "t_00"}, {"d", "t_01"}, {"e", "t_02"}, {"f", "t_03"},
+		}},
+	}
+	for _, c := range cases {
+		got := cycleTargets("t", c.tables, c.aliases)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("cycleTargets(%d, %v) = %v, want %v", c.tables, c.aliases, got, c.want)
+		}
+		// every shard key value is routed to one of the targets
+		s := &ModStrategy{Tables: c.tables, Aliases: c.aliases}
+		for n := int64(0); n < 100; n++ {
+			alias, table, _ := s.Shard("t", n)
+			if !hasTarget(got, Target{alias, table}) {
+				t.Errorf("tables %d aliases %v: value %d routed to %s.%s out of targets", c.tables, c.aliases, n, alias, table)
+			}
+		}
+	}
+}
+
+func TestRangeStrategy(t *testing.T) {
+	s := NewRangeStrategy(
+		Range{Start: 0, End: 100, Suffix: "0", Alias: "db_0"},
+		Range{Start: 100, End: 200, Suffix: "1", Alias: "db_1"},
+		Range{Start: 200, End: 300, Suffix: "1", Alias: "db_1"},
+	)
+	cases := []struct {
+		value interface{}
+		alias string
+		table string
+		err   bool
+	}{
+		{int64(0), "db_0", "t_0", false},
+		{int64(99), "db_0", "t_0", false},
+		{int64(100), "db_1", "t_1", false},
+		{uint64(299), "db_1", "t_1", false},
+		{"150", "db_1", "t_1", false},
+		{int64(-1), "", "", true},
+		{int64(300), "", "", true},
+		{"x", "", "", true},
+	}
+	for _, c := range cases {
+		alias, table, err := s.Shard("t", c.value)
+		if (err != nil) != c.err || alias != c.alias || table != c.table {
+			t.Errorf("Shard(%v) = %s, %s, %v", c.value, alias, table, err)
+		}
+	}
+
+	targets, _ := s.Shards("t")
+	want := []Target{{"db_0", "t_0"}, {"db_1", "t_1"}}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("Shards = %v, want %v", targets, want)
+	}
+}
+
+func TestDateStrategyShards(t *testing.T) {
+	loc := time.UTC
+	cases := []struct {
+		bucket int
+		start  time.Time
+		end    time.Time
+		want   []string
+		err    bool
+	}{
+		{DateDaily, time.Date(2020, 2, 27, 23, 0, 0, 0, loc), time.Date(2020, 3, 1, 1, 0, 0, 0, loc),
+			[]string{"t_20200227", "t_20200228", "t_20200229", "t_20200301"}, false},
+		{DateDaily, time.Date(2020, 1, 1, 0, 0, 0, 0, loc), time.Date(2020, 1, 1, 12, 0, 0, 0, loc),
+			[]string{"t_20200101"}, false},
+		// a start late in the month doesn't skip the short month after
+		{DateMonthly, time.Date(2020, 1, 31, 0, 0, 0, 0, loc), time.Date(2020, 4, 1, 0, 0, 0, 0, loc),
+			[]string{"t_202001", "t_202002", "t_202003", "t_202004"}, false},
+		{DateMonthly, time.Date(2019, 12, 15, 0, 0, 0, 0, loc), time.Date(2020, 1, 15, 0, 0, 0, 0, loc),
+			[]string{"t_201912", "t_202001"}, false},
+		{DateDaily, time.Date(2020, 1, 2, 0, 0, 0, 0, loc), time.Date(2020, 1, 1, 0, 0, 0, 0, loc), nil, true},
+		{DateDaily, time.Time{}, time.Date(2020, 1, 1, 0, 0, 0, 0, loc), nil, true},
+	}
+	for _, c := range cases {
+		s := &DateStrategy{Bucket: c.bucket, Alias: "db_0", Location: loc, Start: c.start, End: c.end}
+		targets, err := s.Shards("t")
+		if (err != nil) != c.err {
+			t.Errorf("Shards(%v, %v) err %v", c.start, c.end, err)
+			continue
+		}
+		var got []string
+		for _, target := range targets {
+			if target.Alias != "db_0" {
+				t.Errorf("Shards(%v, %v) alias %s", c.start, c.end, target.Alias)
+			}
+			got = append(got, target.Table)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Shards(%v, %v) = %v, want %v", c.start, c.end, got, c.want)
+		}
+	}
+}
+
+func TestDateStrategyTime(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	s := &DateStrategy{Bucket: DateDaily, Location: loc}
+	cases := []struct {
+		value interface{}
+		table string
+		err   bool
+	}{
+		// 2020-01-01 16:00:00 UTC is the next day in UTC+8
+		{int64(1577894400), "t_20200102", false},
+		{uint64(1577894400), "t_20200102", false},
+		{"2020-01-01 23:59:59", "t_20200101", false},
+		{"2020-01-01", "t_20200101", false},
+		{"2020/01/01", "", true},
+		{1577894400, "", true},
+	}
+	for _, c := range cases {
+		_, table, err := s.Shard("t", c.value)
+		if (err != nil) != c.err || table != c.table {
+			t.Errorf("Shard(%v) = %s, %v", c.value, table, err)
+		}
+	}
+
+	tm, err := s.time("2020-01-01 08:00:00")
+	if err != nil || !tm.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("time parsed as %v, %v, want it in the strategy location", tm, err)
+	}
+}
@@ -0,0 +1,281 @@
+package sharding
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// delay before the db of a removed or replaced alias is closed, orm created
+// on the old topology keeps using it meanwhile
+var DrainTimeout = 30 * time.Second
+
+// snapshot of a registry, the db of every alias, models and the strategy of
+// every sharded model. a stored snapshot is never changed, a change swaps in
+// a new one so an orm finishes on the snapshot it was created with
+type topology struct {
+	dbs         map[string]*sql.DB
+	dsns        map[string]string
+	replicas    map[string]*replicaSet
+	models      map[string]*modelInfo
+	strategies  map[string]ShardStrategy
+	idgens      map[string]IdGenerator
+	lookupAlias string
+	xaLogAlias  string
+	xaLogTable  string
+	// replica reads, see SetReplicaPolicy, SetMaxReplicaLag and
+	// SetLagHeartbeatTable
+	replicaPolicy int
+	maxLag        time.Duration
+	heartbeat     string
+}
+
+func newTopology() *topology {
+	return &topology{
+		dbs:        make(map[string]*sql.DB),
+		dsns:       make(map[string]string),
+		replicas:   make(map[string]*replicaSet),
+		models:     make(map[string]*modelInfo),
+		strategies: make(map[string]ShardStrategy),
+		idgens:     make(map[string]IdGenerator),
+		maxLag:     time.Second,
+	}
+}
+
+// strategy of model, nil if not sharded
+func (t *topology) strategy(model *modelInfo) ShardStrategy {
+	return t.strategies[model.fullName]
+}
+
+func (t *topology) clone() *topology {
+	c := newTopology()
+	for alias, db := range t.dbs {
+		c.dbs[alias] = db
+	}
+	for alias, dsn := range t.dsns {
+		c.dsns[alias] = dsn
+	}
+	for alias, s := range t.replicas {
+		c.replicas[alias] = s
+	}
+	for name, m := range t.models {
+		c.models[name] = m
+	}
+	for name, s := range t.strategies {
+		c.strategies[name] = s
+	}
+	for name, g := range t.idgens {
+		c.idgens[name] = g
+	}
+	c.lookupAlias, c.xaLogAlias, c.xaLogTable = t.lookupAlias, t.xaLogAlias, t.xaLogTable
+	c.replicaPolicy, c.maxLag, c.heartbeat = t.replicaPolicy, t.maxLag, t.heartbeat
+	return c
+}
+
+// dbs of every alias and replica
+func (t *topology) all() []*sql.DB {
+	dbs := make([]*sql.DB, 0, len(t.dbs))
+	for _, db := range t.dbs {
+		dbs = append(dbs, db)
+	}
+	for _, s := range t.replicas {
+		dbs = append(dbs, s.dbs...)
+	}
+	return dbs
+}
+
+// registered models in a stable order
+func (t *topology) sortedModels() []*modelInfo {
+	names := make([]string, 0, len(t.models))
+	for name := range t.models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]*modelInfo, 0, len(names))
+	for _, name := range names {
+		list = append(list, t.models[name])
+	}
+	return list
+}
+
+func closeAll(dbs []*sql.DB) {
+	for _, db := range dbs {
+		db.Close()
+	}
+}
+
+// close db after DrainTimeout, Close waits for running queries
+func drain(db *sql.DB) {
+	time.AfterFunc(DrainTimeout, func() {
+		db.Close()
+	})
+}
+
+// remove a db alias at runtime, orm created before keep using it until
+// DrainTimeout
+func (r *Registry) RemoveDataBase(aliasName string) error {
+	return r.update(func(t *topology) error {
+		if _, ok := t.dbs[aliasName]; !ok {
+			return fmt.Errorf("<sharding.RemoveDataBase> unknown db alias name `%s`", aliasName)
+		}
+		if aliasName == t.lookupAlias || aliasName == t.xaLogAlias {
+			return fmt.Errorf("<sharding.RemoveDataBase> db alias `%s` in use can't be removed", aliasName)
+		}
+		delete(t.dbs, aliasName)
+		delete(t.dsns, aliasName)
+		delete(t.replicas, aliasName)
+		return nil
+	})
+}
+
+func RemoveDataBase(aliasName string) error {
+	return defaultRegistry.RemoveDataBase(aliasName)
+}
+
+// replace the strategy of a registered sharded model at runtime
+func (r *Registry) SetStrategy(md interface{}, strategy ShardStrategy) error {
+	fullName := getFullName(md)
+	return r.update(func(t *topology) error {
+		model, ok := t.models[fullName]
+		if !ok {
+			return fmt.Errorf("<sharding.SetStrategy> unknown model name `%s`", fullName)
+		}
+		if err := checkStrategy(model, strategy); err != nil {
+			return fmt.Errorf("<sharding.SetStrategy> %s", err.Error())
+		}
+		s, err := r.bindStrategy(t, strategy)
+		if err != nil {
+			return fmt.Errorf("<sharding.SetStrategy> %s", err.Error())
+		}
+		t.strategies[fullName] = s
+		return nil
+	})
+}
+
+func SetStrategy(md interface{}, strategy ShardStrategy) error {
+	return defaultRegistry.SetStrategy(md, strategy)
+}
+
+// whether strategy fits the shard column of model
+func checkStrategy(model *modelInfo, strategy ShardStrategy) error {
+	if _, ok := strategy.(*BroadcastStrategy); ok {
+		if len(model.shard) > 0 {
+			return fmt.Errorf("broadcast model `%s` can't have shard column", model.fullName)
+		}
+		// db auto increment may give a row different ids on every alias
+		if len(model.auto) == 0 && len(model.uk) == 0 {
+			return fmt.Errorf("broadcast model `%s` needs an auto primary key or a unique key", model.fullName)
+		}
+	} else if len(model.shard) == 0 {
+		return fmt.Errorf("model `%s` have no shard column, may be miss setting tag", model.fullName)
+	}
+	return nil
+}
+
+// reload the topology file and apply it, see ApplyConfig
+func (r *Registry) ReloadConfig(path string) error {
+	c, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	return r.ApplyConfig(c)
+}
+
+func ReloadConfig(path string) error {
+	return defaultRegistry.ReloadConfig(path)
+}
+
+// swap in the topology of config at runtime: aliases not in config are
+// removed, aliases whose dsn changed are reopened, and models of registered
+// tables in config get their new strategy. orm created before keep routing
+// on the old topology and its removed dbs are closed after DrainTimeout
+func (r *Registry) ApplyConfig(c *Config) error {
+	return r.update(func(t *topology) error {
+		// table of several models is ambiguous and left empty
+		tables := make(map[string]string)
+		for name, m := range t.models {
+			if _, ok := tables[m.table]; ok {
+				tables[m.table] = ""
+			} else {
+				tables[m.table] = name
+			}
+		}
+		if err := c.validate(tables, nil); err != nil {
+			return err
+		}
+		for _, alias := range []string{t.lookupAlias, t.xaLogAlias} {
+			if len(alias) > 0 && !c.hasAlias(alias) {
+				return fmt.Errorf("<sharding.Config> database alias `%s` in use can't be removed", alias)
+			}
+		}
+		strategies := make(map[string]ShardStrategy, len(c.Models))
+		for _, mc := range c.Models {
+			name := tables[mc.Table]
+			if len(name) == 0 {
+				return fmt.Errorf("<sharding.Config> table `%s` of several models", mc.Table)
+			}
+			s, err := mc.strategy(tables)
+			if err == nil {
+				err = checkStrategy(t.models[name], s)
+			}
+			if err != nil {
+				return fmt.Errorf("<sharding.Config> model `%s`, %s", mc.Table, err.Error())
+			}
+			strategies[name] = s
+		}
+
+		dbs := make(map[string]*sql.DB, len(c.DataBases))
+		dsns := make(map[string]string, len(c.DataBases))
+		replicas := make(map[string]*replicaSet, len(c.DataBases))
+		var opened []*sql.DB
+		for _, dc := range c.DataBases {
+			db, ok := t.dbs[dc.Alias]
+			if ok && t.dsns[dc.Alias] == dc.DSN {
+				dc.pool(db)
+			} else {
+				var err error
+				if db, err = dc.open(dc.DSN); err != nil {
+					closeAll(opened)
+					return err
+				}
+				opened = append(opened, db)
+			}
+			dbs[dc.Alias], dsns[dc.Alias] = db, dc.DSN
+
+			set, added, err := dc.replicas(t.replicas[dc.Alias])
+			if err != nil {
+				closeAll(opened)
+				return err
+			}
+			opened = append(opened, added...)
+			if set != nil {
+				replicas[dc.Alias] = set
+			}
+		}
+		t.dbs, t.dsns, t.replicas = dbs, dsns, replicas
+		for name, s := range strategies {
+			bound, err := r.bindStrategy(t, s)
+			if err != nil {
+				closeAll(opened)
+				return fmt.Errorf("<sharding.Config> model `%s`, %s", name, err.Error())
+			}
+			t.strategies[name] = bound
+		}
+		return nil
+	})
+}
+
+// apply config to the default registry, see Registry.ApplyConfig
+func (c *Config) Apply() error {
+	return defaultRegistry.ApplyConfig(c)
+}
+
+func (c *Config) hasAlias(alias string) bool {
+	for _, dc := range c.DataBases {
+		if dc.Alias == alias {
+			return true
+		}
+	}
+	return false
+}
@@ -16,6 +16,19 @@ type modelInfo struct {
 	columns string
 	uk 	string
 	pk 	string
+	table	string
+	shard	string
+	auto	string
+	lookups	[]string
+}
+
+// column of a column or field name
+func (m *modelInfo) column(name string) (string, bool) {
+	if _, ok := m.c2n[name]; ok {
+		return name, true
+	}
+	column, ok := m.n2c[name]
+	return column, ok
 }
 
 type fieldInfo struct {
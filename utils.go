@@ -21,29 +21,35 @@ const (
 )
 
 var (
-	dbConn map[string]*sql.DB
-	models map[string]*modelInfo
 	supportTag = map[string]int{
 		"pk":           1,
 		"uk":       1,
 		"column":       2,
+		"shard":        2,
+		"auto":         2,
+		"index_lookup": 2,
 	}
 )
 
-func init() {
-	dbConn = make(map[string]*sql.DB)
-	models = make(map[string]*modelInfo)
+//create an orm with model, `DB` is optional for sharded model  
+func NewOrm(md interface{}) (Eorm, error) {
+    return defaultRegistry.NewOrm(md)
 }
 
-//create an orm with model  
-func NewOrm(md interface{}) (Eorm, error) {
+//create an orm, every operation outside transaction routes on the snapshot
+//of registry current when it starts
+func (r *Registry) NewOrm(md interface{}) (Eorm, error) {
     o := new(orm)
     o.isTx = false
+    o.reg = r
+    o.topo = r.load()
     v := reflect.ValueOf(md).MethodByName("DB")
     var err error
     if v.IsValid() {
         sAlias := v.Call([]reflect.Value{})
         err = o.Using(sAlias[0].String())
+    } else if m, ok := o.topo.models[getFullName(md)]; ok && o.topo.strategy(m) != nil {
+        // db alias of sharded model is routed per operation
     } else {
         err = fmt.Errorf("The func `DB` undefine in `%s`", reflect.Indirect(reflect.ValueOf(md)).Type())
     }
@@ -53,28 +59,17 @@ func NewOrm(md interface{}) (Eorm, error) {
 
 //build db connection
 func RegisterDataBase(aliasName, dataSource string, params ...int) error {
-	var (
-		err error
-		db  *sql.DB
-	)
+	return defaultRegistry.RegisterDataBase(aliasName, dataSource, params...)
+}
 
+func (r *Registry) RegisterDataBase(aliasName, dataSource string, params ...int) error {
 	//验证是否已注册
-	if _, ok := dbConn[aliasName]; ok {
+	if _, ok := r.load().dbs[aliasName]; ok {
 		return fmt.Errorf("alias name `%s` have been registered", aliasName)
-	} else {
-		db, err = sql.Open(DriverName, dataSource)
-		if err != nil {
-			err = fmt.Errorf("register db open `%s` , %s", aliasName, err.Error())
-			goto end
-		}	
-		dbConn[aliasName] = db
 	}
-
-	//联通新验证
-	err = db.Ping()
+	db, err := openDataBase(aliasName, dataSource)
 	if err != nil {
-		return fmt.Errorf("register db Ping `%s`, %s", aliasName, err.Error())
-		goto end
+		return err
 	}
 
 	for i, v := range params {
@@ -86,26 +81,79 @@ func RegisterDataBase(aliasName, dataSource string, params ...int) error {
 		}
 	}
 
-end:
+	if err = r.addDataBase(aliasName, dataSource, db); err != nil {
+		db.Close()
+	}
+	return err
+}
+
+// open and ping db of alias
+func openDataBase(aliasName, dataSource string) (*sql.DB, error) {
+	db, err := sql.Open(DriverName, dataSource)
 	if err != nil {
-		if db != nil {
-			db.Close()
+		return nil, fmt.Errorf("register db open `%s` , %s", aliasName, err.Error())
+	}
+
+	//联通新验证
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("register db Ping `%s`, %s", aliasName, err.Error())
+	}
+	return db, nil
+}
+
+// add db of alias to the registry
+func (r *Registry) addDataBase(aliasName, dataSource string, db *sql.DB) error {
+	return r.update(func(t *topology) error {
+		if _, ok := t.dbs[aliasName]; ok {
+			return fmt.Errorf("alias name `%s` have been registered", aliasName)
 		}
+		t.dbs[aliasName] = db
+		t.dsns[aliasName] = dataSource
+		return nil
+	})
+}
+
+//must register modelinfo before used, sharded model tagged with
+//`shard(column)` attach its strategy here
+func RegisterModel(md interface{}, strategy ...ShardStrategy) {
+	defaultRegistry.RegisterModel(md, strategy...)
+}
+
+func (r *Registry) RegisterModel(md interface{}, strategy ...ShardStrategy) {
+	model := newModelInfo(md, strategy...)
+	err := r.update(func(t *topology) error {
+		return r.addModel(t, model, strategy...)
+	})
+	if err != nil {
+		panic(err)
 	}
+}
 
-	return err
+// add model and its strategy to t
+func (r *Registry) addModel(t *topology, model *modelInfo, strategy ...ShardStrategy) error {
+	if _, ok := t.models[model.fullName]; ok {
+		return fmt.Errorf("<sharding.RegisterModel> model `%s` repeat register ", model.fullName)
+	}
+	if len(strategy) > 0 {
+		s, err := r.bindStrategy(t, strategy[0])
+		if err != nil {
+			return fmt.Errorf("<sharding.RegisterModel> model `%s` %s", model.fullName, err.Error())
+		}
+		t.strategies[model.fullName] = s
+	}
+	t.models[model.fullName] = model
+	return nil
 }
 
-//must register modelinfo before used
-func RegisterModel(md interface{}) {
+// parse the fields and tags of md, it panics on an invalid model
+func newModelInfo(md interface{}, strategy ...ShardStrategy) *modelInfo {
 	fullName := getFullName(md)
-	if _,ok := models[fullName]; ok {
-		panic(fmt.Errorf("<sharding.RegisterModel> model `%s` repeat register ", fullName))
-	} 
 
 	model := &modelInfo{}
 	model.fullName = fullName
 	model.name = getName(md)
+	model.table = getTableName(md)
 	model.fields = make(map[string]*fieldInfo)
 	model.c2n = make(map[string]string)
 	model.n2c = make(map[string]string)
@@ -117,6 +165,8 @@ func RegisterModel(md interface{}) {
 		attrs     map[string]bool
 		tags      map[string]string
 		sf  	  reflect.StructField
+		shardKey  string
+		lookups   []string
 	)
 	for i := 0; i < ind.NumField(); i++ {
 		sf = ind.Type().Field(i)
@@ -144,6 +194,24 @@ func RegisterModel(md interface{}) {
 			model.uk = fi.colume
 		}
 
+		if v,ok := tags["shard"]; ok {
+			shardKey = v
+		}
+
+		if v,ok := tags["index_lookup"]; ok {
+			lookups = append(lookups, strings.Split(v, ColumnDelim)...)
+		}
+
+		if v,ok := tags["auto"]; ok {
+			if !fi.pk {
+				panic(fmt.Errorf("<sharding.RegisterModel> model `%s` auto id must be primary key", fullName))
+			}
+			if fi.fieldType != TypeBigIntegerField && fi.fieldType != TypePositiveBigIntegerField {
+				panic(fmt.Errorf("<sharding.RegisterModel> model `%s` auto id must be int64 or uint64", fullName))
+			}
+			model.auto = v
+		}
+
 		model.fields[fi.colume] = fi
 		model.c2n[fi.colume] = fi.name
 		model.n2c[fi.name] = fi.colume
@@ -154,7 +222,36 @@ func RegisterModel(md interface{}) {
 		panic(fmt.Errorf("<sharding.RegisterModel> model `%s` must have primary or unique key  ", fullName))
 	}
 
-	models[fullName] = model
+	if len(shardKey) > 0 {
+		if _, ok := model.c2n[shardKey]; ok {
+			model.shard = shardKey
+		} else if v, ok := model.n2c[shardKey]; ok {
+			model.shard = v
+		} else {
+			panic(fmt.Errorf("<sharding.RegisterModel> model `%s` unknown shard column `%s`", fullName, shardKey))
+		}
+	}
+
+	for _, v := range lookups {
+		v = strings.TrimSpace(v)
+		if _, ok := model.c2n[v]; ok {
+			model.lookups = append(model.lookups, v)
+		} else if c, ok := model.n2c[v]; ok {
+			model.lookups = append(model.lookups, c)
+		} else {
+			panic(fmt.Errorf("<sharding.RegisterModel> model `%s` unknown lookup column `%s`", fullName, v))
+		}
+	}
+	if len(model.lookups) > 0 && len(model.shard) == 0 {
+		panic(fmt.Errorf("<sharding.RegisterModel> model `%s` have lookup column but no shard column", fullName))
+	}
+
+	if len(strategy) > 0 {
+		if err := checkStrategy(model, strategy[0]); err != nil {
+			panic(fmt.Errorf("<sharding.RegisterModel> %s", err.Error()))
+		}
+	}
+	return model
 }
 
 //parse table struct setting
@@ -201,6 +298,54 @@ func getFullName(md interface{}) string {
 	return typ.PkgPath() + "." + typ.Name()
 }
 
+// get model info and slice value of a model slice ptr
+func (t *topology) sliceModel(res interface{}) (*modelInfo, reflect.Value, error) {
+	v := reflect.ValueOf(res)
+	if v.Kind() != reflect.Ptr || reflect.Indirect(v).Kind() != reflect.Slice {
+		return nil, v, ErrNoModel
+	}
+	slice := reflect.Indirect(v)
+	typ := slice.Type().Elem()
+	m, ok := t.models[typ.PkgPath()+"."+typ.Name()]
+	if !ok {
+		return nil, slice, ErrUnkownModel
+	}
+	return m, slice, nil
+}
+
+// scan rows into new model values of typ, rows is closed after scan
+func scanRows(rows *sql.Rows, m *modelInfo, typ reflect.Type) ([]reflect.Value, error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]interface{}, len(columns))
+	for i := range refs {
+		var ref interface{}
+		refs[i] = &ref
+	}
+
+	var objs []reflect.Value
+	for rows.Next() {
+		if err = rows.Scan(refs...); err != nil {
+			return nil, err
+		}
+		ind := reflect.Indirect(reflect.New(typ))
+		for i, col := range columns {
+			fieldDes, ok := m.fields[col]
+			if !ok {
+				return nil, ErrUnkownColumn
+			}
+			valRaw := reflect.Indirect(reflect.ValueOf(refs[i])).Interface()
+			field := ind.FieldByName(m.c2n[col])
+			setFieldValue(fieldDes, convertValueFromDB(fieldDes, valRaw), field)
+		}
+		objs = append(objs, ind)
+	}
+	return objs, rows.Err()
+}
+
 // return field type as type constant from reflect.Value
 func getFieldType(val reflect.Value) (ft int) {
 	switch val.Type() {
@@ -0,0 +1,131 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// condition of UpdateWhere and DeleteWhere, expr is as in Filter:
+//   o.DeleteWhere(&Order{}, Where("user_id", 7), Where("status__in", 3, 4))
+type Cond struct {
+	expr string
+	args []interface{}
+	not  bool
+	all  bool
+}
+
+func Where(expr string, args ...interface{}) Cond {
+	return Cond{expr: expr, args: args}
+}
+
+// negated condition as in Exclude
+func WhereNot(expr string, args ...interface{}) Cond {
+	return Cond{expr: expr, args: args, not: true}
+}
+
+// condition matching every row, UpdateWhere and DeleteWhere refuse to run
+// without conditions unless it is given
+var AllRows = Cond{all: true}
+
+// update the columns in values of the rows of md matched by conds, keys of
+// values are column or field names. keys, the shard column and lookup
+// columns can't be updated. like Exec it is refused on a migrating bucket.
+// it returns the rows affected on every shard
+func (o *orm) UpdateWhere(md interface{}, values map[string]interface{}, conds ...Cond) (int64, error) {
+	return o.UpdateWhereContext(context.Background(), md, values, conds...)
+}
+
+func (o *orm) UpdateWhereContext(ctx context.Context, md interface{}, values map[string]interface{}, conds ...Cond) (int64, error) {
+	o.reload()
+	qs, err := o.whereSet(md, conds)
+	if err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return 0, fmt.Errorf("<orm.UpdateWhere> no column to update")
+	}
+	m := qs.model
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sets := make([]string, 0, len(names))
+	args := make([]interface{}, 0, len(names)+len(qs.args))
+	for _, name := range names {
+		column, ok := m.column(name)
+		if !ok {
+			return 0, fmt.Errorf("<orm.UpdateWhere> unknown column name `%s`", name)
+		}
+		if column == m.uk || column == m.pk {
+			return 0, fmt.Errorf("<orm.UpdateWhere> can't update unique key `%s`", column)
+		}
+		if column == m.shard && o.topo.strategy(m) != nil {
+			return 0, fmt.Errorf("<orm.UpdateWhere> can't update shard key `%s`", column)
+		}
+		if isLookup(m, column) {
+			return 0, fmt.Errorf("<orm.UpdateWhere> can't update lookup column `%s`", column)
+		}
+		sets = append(sets, TableQuote+column+TableQuote+" = ?")
+		args = append(args, values[name])
+	}
+
+	query := fmt.Sprintf("UPDATE %s%s%s SET %s", TableQuote, m.table, TableQuote, strings.Join(sets, ", "))
+	return o.execWhere(ctx, qs, query, args)
+}
+
+// delete the rows of md matched by conds, a sharded model with lookup
+// columns is refused since its lookup entries would be left, use Delete.
+// it returns the rows affected on every shard
+func (o *orm) DeleteWhere(md interface{}, conds ...Cond) (int64, error) {
+	return o.DeleteWhereContext(context.Background(), md, conds...)
+}
+
+func (o *orm) DeleteWhereContext(ctx context.Context, md interface{}, conds ...Cond) (int64, error) {
+	o.reload()
+	qs, err := o.whereSet(md, conds)
+	if err != nil {
+		return 0, err
+	}
+	if len(qs.model.lookups) > 0 && o.topo.strategy(qs.model) != nil {
+		return 0, fmt.Errorf("<orm.DeleteWhere> model `%s` have lookup columns, use Delete", qs.model.fullName)
+	}
+	query := fmt.Sprintf("DELETE FROM %s%s%s", TableQuote, qs.model.table, TableQuote)
+	return o.execWhere(ctx, qs, query, nil)
+}
+
+// conditions of md, an empty one without AllRows is refused
+func (o *orm) whereSet(md interface{}, conds []Cond) (*querySet, error) {
+	qs := o.QueryTable(md).(*querySet)
+	all := false
+	for _, c := range conds {
+		if c.all {
+			all = true
+			continue
+		}
+		qs = qs.where(c.not, c.expr, c.args).(*querySet)
+	}
+	if qs.err != nil {
+		return nil, qs.err
+	}
+	if len(qs.conds) == 0 && !all {
+		return nil, fmt.Errorf("<orm> no condition for every row of `%s`, pass AllRows", qs.model.table)
+	}
+	return qs, nil
+}
+
+// run query with the WHERE of qs on the shards it is routed to
+func (o *orm) execWhere(ctx context.Context, qs *querySet, query string, args []interface{}) (int64, error) {
+	if len(qs.conds) > 0 {
+		query += " WHERE " + strings.Join(qs.conds, " AND ")
+		args = append(args, qs.args...)
+	}
+	res, err := o.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
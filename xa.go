@@ -0,0 +1,290 @@
+package sharding
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix of gtrid created by orm, RecoverXA only resolves these branches
+const XAPrefix = "sharding-"
+
+//register the decision log of distributed transactions on alias:
+//  CREATE TABLE `table` (`gtrid` VARCHAR(64) PRIMARY KEY, `created` BIGINT NOT NULL)
+//a gtrid is logged after all branches prepared and before they commit,
+//BeginXA is refused until the log is registered
+func RegisterXALog(alias, table string) error {
+	return defaultRegistry.RegisterXALog(alias, table)
+}
+
+func (r *Registry) RegisterXALog(alias, table string) error {
+	return r.update(func(t *topology) error {
+		if _, ok := t.dbs[alias]; !ok {
+			return fmt.Errorf("<sharding.RegisterXALog> unknown db alias name `%s`", alias)
+		}
+		t.xaLogAlias, t.xaLogTable = alias, table
+		return nil
+	})
+}
+
+// distributed transaction, a branch is started lazily on every alias touched
+type xaTx struct {
+	mu       sync.Mutex
+	gtrid    string
+	topo     *topology
+	branches map[string]*sql.Conn
+	aliases  []string
+	// branches failed to commit or roll back, their sessions are discarded
+	failed map[string]bool
+}
+
+// begin a distributed transaction, commit runs XA PREPARE on every branch
+// then XA COMMIT, a single branch is committed in one phase. the decision
+// log of RegisterXALog is required
+func (o *orm) BeginXA() error {
+	o.reload()
+	if o.isTx || o.xa != nil {
+		return ErrTxHasBegan
+	}
+	if len(o.topo.xaLogAlias) == 0 {
+		return fmt.Errorf("<orm.BeginXA> no decision log, call RegisterXALog first")
+	}
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	o.xa = &xaTx{gtrid: XAPrefix + hex.EncodeToString(b), topo: o.topo, branches: make(map[string]*sql.Conn)}
+	return nil
+}
+
+func (o *orm) commitXA() error {
+	x := o.xa
+	o.xa = nil
+	defer x.close()
+
+	if len(x.aliases) == 0 {
+		return nil
+	}
+	if len(x.aliases) == 1 {
+		alias := x.aliases[0]
+		err := x.exec(alias, "XA END")
+		if err == nil {
+			err = x.exec(alias, "XA COMMIT", "ONE PHASE")
+		}
+		if err != nil {
+			x.rollback()
+		}
+		return err
+	}
+
+	for _, alias := range x.aliases {
+		err := x.exec(alias, "XA END")
+		if err == nil {
+			err = x.exec(alias, "XA PREPARE")
+		}
+		if err != nil {
+			x.rollback()
+			return fmt.Errorf("<orm.Commit> prepare `%s` failed and rolled back, %s", alias, err.Error())
+		}
+	}
+	if err := x.topo.logXA(x.gtrid); err != nil {
+		x.rollback()
+		return fmt.Errorf("<orm.Commit> log `%s` failed and rolled back, %s", x.gtrid, err.Error())
+	}
+
+	var failed []string
+	for _, alias := range x.aliases {
+		if err := x.exec(alias, "XA COMMIT"); err != nil {
+			x.fail(alias)
+			failed = append(failed, alias+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("<orm.Commit> `%s` in doubt, run RecoverXA, %s", x.gtrid, strings.Join(failed, "; "))
+	}
+	x.topo.unlogXA(x.gtrid)
+	return nil
+}
+
+func (o *orm) rollbackXA() error {
+	x := o.xa
+	o.xa = nil
+	defer x.close()
+	return x.rollback()
+}
+
+// xid of the branch on alias
+func (x *xaTx) xid(alias string) string {
+	return fmt.Sprintf("'%s','%s'", x.gtrid, hex.EncodeToString([]byte(alias)))
+}
+
+// start the branch on alias when it is touched first
+func (x *xaTx) branch(ctx context.Context, alias string) (sqlQuerier, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if conn, ok := x.branches[alias]; ok {
+		return conn, nil
+	}
+
+	db, ok := x.topo.dbs[alias]
+	if !ok {
+		return nil, fmt.Errorf("<orm> unknown db alias name `%s`", alias)
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.ExecContext(ctx, "XA START "+x.xid(alias)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	x.branches[alias] = conn
+	x.aliases = append(x.aliases, alias)
+	return conn, nil
+}
+
+func (x *xaTx) exec(alias, stmt string, suffix ...string) error {
+	query := stmt + " " + x.xid(alias)
+	if len(suffix) > 0 {
+		query += " " + strings.Join(suffix, " ")
+	}
+	_, err := x.branches[alias].ExecContext(context.Background(), query)
+	return err
+}
+
+// roll back every branch, XA END fails for branches already ended
+func (x *xaTx) rollback() error {
+	var failed []string
+	for _, alias := range x.aliases {
+		x.exec(alias, "XA END")
+		if err := x.exec(alias, "XA ROLLBACK"); err != nil {
+			x.fail(alias)
+			failed = append(failed, alias+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("<orm.Rollback> `%s` rollback failed, %s", x.gtrid, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (x *xaTx) fail(alias string) {
+	if x.failed == nil {
+		x.failed = make(map[string]bool)
+	}
+	x.failed[alias] = true
+}
+
+// return the connections to pool, a session holding a failed branch would
+// reject later statements and keep the branch from RecoverXA, it is closed
+func (x *xaTx) close() {
+	for alias, conn := range x.branches {
+		if x.failed[alias] {
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}
+}
+
+func (t *topology) logXA(gtrid string) error {
+	if len(t.xaLogAlias) == 0 {
+		return fmt.Errorf("no decision log")
+	}
+	query := fmt.Sprintf("INSERT INTO %s%s%s (`gtrid`, `created`) VALUES (?, ?)", TableQuote, t.xaLogTable, TableQuote)
+	_, err := t.dbs[t.xaLogAlias].Exec(query, gtrid, time.Now().Unix())
+	return err
+}
+
+// a gtrid left in log is cleaned by RecoverXA
+func (t *topology) unlogXA(gtrid string) {
+	if len(t.xaLogAlias) == 0 {
+		return
+	}
+	query := fmt.Sprintf("DELETE FROM %s%s%s WHERE `gtrid` = ?", TableQuote, t.xaLogTable, TableQuote)
+	t.dbs[t.xaLogAlias].Exec(query, gtrid)
+}
+
+// resolve in-doubt branches on every registered alias left by a crash,
+// branches of logged gtrid are committed and the others rolled back.
+// run it before serving, a transaction preparing at the same time may be
+// rolled back
+func RecoverXA() error {
+	return defaultRegistry.RecoverXA()
+}
+
+func (r *Registry) RecoverXA() error {
+	t := r.load()
+	start := time.Now().Unix()
+	var failed []string
+	for alias, db := range t.dbs {
+		if err := t.recoverXA(db); err != nil {
+			failed = append(failed, alias+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("<sharding.RecoverXA> %s", strings.Join(failed, "; "))
+	}
+	if len(t.xaLogAlias) > 0 {
+		query := fmt.Sprintf("DELETE FROM %s%s%s WHERE `created` <= ?", TableQuote, t.xaLogTable, TableQuote)
+		if _, err := t.dbs[t.xaLogAlias].Exec(query, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *topology) recoverXA(db *sql.DB) error {
+	rows, err := db.Query("XA RECOVER")
+	if err != nil {
+		return err
+	}
+	var xids [][2]string
+	for rows.Next() {
+		var (
+			formatId, gtridLen, bqualLen int
+			data                         string
+		)
+		if err = rows.Scan(&formatId, &gtridLen, &bqualLen, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		if gtridLen+bqualLen <= len(data) && strings.HasPrefix(data, XAPrefix) {
+			xids = append(xids, [2]string{data[:gtridLen], data[gtridLen : gtridLen+bqualLen]})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, xid := range xids {
+		logged, err := t.isLoggedXA(xid[0])
+		if err != nil {
+			return err
+		}
+		stmt := "XA ROLLBACK"
+		if logged {
+			stmt = "XA COMMIT"
+		}
+		if _, err = db.Exec(fmt.Sprintf("%s '%s','%s'", stmt, xid[0], xid[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *topology) isLoggedXA(gtrid string) (bool, error) {
+	if len(t.xaLogAlias) == 0 {
+		return false, nil
+	}
+	var n int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s%s%s WHERE `gtrid` = ?", TableQuote, t.xaLogTable, TableQuote)
+	err := t.dbs[t.xaLogAlias].QueryRow(query, gtrid).Scan(&n)
+	return n > 0, err
+}